@@ -0,0 +1,387 @@
+package main
+
+import (
+  "database/sql"
+  "io"
+  "io/ioutil"
+  "log"
+  "net/http"
+  "net/url"
+  "regexp"
+  "strconv"
+  "strings"
+  "time"
+  "github.com/gin-gonic/gin"
+  "github.com/garyburd/redigo/redis"
+  "github.com/lib/pq"
+  "golang.org/x/crypto/bcrypt"
+)
+
+/******************************************************************************
+ * Constants
+ *****************************************************************************/
+
+const (
+    pqUniqueViolation pq.ErrorCode = "23505"
+
+    // accounts without a password confirm changes by having just logged in
+    ConfirmLoginAge       time.Duration = time.Minute * 5
+    DeleteAccountFormSize int64         = 4096
+)
+
+/******************************************************************************
+ * Helper functions
+ *****************************************************************************/
+
+// remove everything kept about a user in redis
+func eraseUserRedisData(userId int, emailAddr string) error {
+    if err := deleteUserSessions(userId); err != nil {
+        return err
+    }
+
+    con := stores.redisPool.Get()
+    defer con.Close()
+
+    // progress counters left from before progress moved to postgres
+    match := "progress:" + strconv.Itoa(userId) + ":*"
+    cursor := 0
+    for {
+        r, err := redis.Values(con.Do("SCAN", cursor, "MATCH", match,
+                                      "COUNT", 100))
+        if err != nil || len(r) != 2 {
+            return err
+        }
+
+        cursor, _ = redis.Int(r[0], nil)
+        keys, _ := redis.Strings(r[1], nil)
+        for _, key := range keys {
+            con.Send("DEL", key)
+        }
+
+        if cursor == 0 {
+            break
+        }
+    }
+
+    // lobbies expire by themselves
+    con.Send("ZREM", "leaderboard", userId)
+    con.Send("DEL", "verify-resend:" + strconv.Itoa(userId))
+    con.Send("DEL", "login-failures:" + normalizeEmail(emailAddr))
+    _, err := con.Do("DEL", "lockout:" + normalizeEmail(emailAddr))
+    return err
+}
+
+// tell the old address it was replaced, so an owner who didn't ask for it
+// knows their account was taken over
+func sendEmailChangedMail(oldEmailAddr string, newEmailAddr string) error {
+    body := "The email address of your Firmament account was changed to " +
+            newEmailAddr + ".\n\n" +
+            "If this wasn't you, your account may have been taken over, " +
+            "please contact the site administrators."
+    return mailer.Send(oldEmailAddr, "Your Firmament email address was changed",
+                       body)
+}
+
+// form sent with a DELETE, which net/http only parses for POST, PUT and PATCH
+func deleteRequestForm(c *gin.Context) url.Values {
+    if c.Request.Body == nil {
+        return url.Values{}
+    }
+
+    body, err := ioutil.ReadAll(io.LimitReader(c.Request.Body,
+                                               DeleteAccountFormSize))
+    if err != nil {
+        return url.Values{}
+    }
+
+    form, err := url.ParseQuery(string(body))
+    if err != nil {
+        return url.Values{}
+    }
+
+    return form
+}
+
+// check that the user making a change which a stolen session alone shouldn't
+// allow is who they say they are, with their password or for accounts without
+// one a session that just logged in, returns what is wrong or an empty string
+// if confirmed
+func confirmUser(userId int, token string, password string,
+                 action string) (string, error) {
+    var passwordHash []byte
+    err := stores.sqlPool.QueryRow(
+        "SELECT password FROM webapp.user WHERE user_id=$1",
+        userId).Scan(&passwordHash)
+    if err != nil {
+        return "", err
+    }
+
+    if len(passwordHash) > 0 {
+        err = bcrypt.CompareHashAndPassword(passwordHash, []byte(password))
+        if err != nil {
+            return "password is incorrect", nil
+        }
+        return "", nil
+    }
+
+    con := stores.redisPool.Get()
+    defer con.Close()
+
+    created, err := redis.Int64(con.Do("HGET",
+                                       "session:" + sessionTokenHash(token),
+                                       "created"))
+    if err != nil && err != redis.ErrNil {
+        return "", err
+    }
+
+    if err == redis.ErrNil ||
+       time.Since(time.Unix(created, 0)) >= ConfirmLoginAge {
+        return "please login again to " + action, nil
+    }
+    return "", nil
+}
+
+/******************************************************************************
+ * Handlers
+ *****************************************************************************/
+
+func handleUpdateProfile(c *gin.Context) {
+    // get userid of logged in user, abort if 0
+    userId, token := getLoggedInUser(c)
+    if userId <= 0 {
+        c.JSON(401, gin.H{"error": "not logged in"})
+        return
+    }
+
+    var firstName string
+    var lastName string
+    var email string
+    var displayName sql.NullString
+    var showRealName bool
+    err := stores.sqlPool.QueryRow(
+        "SELECT first_name, last_name, email, display_name, show_real_name " +
+        "FROM webapp.user WHERE user_id=$1", userId).Scan(
+        &firstName, &lastName, &email, &displayName, &showRealName)
+    if err != nil {
+        c.JSON(500, gin.H{"error": "unexpected error occurred"})
+        return
+    }
+
+    // only change the fields given
+    newFirstName := c.DefaultPostForm("first_name", firstName)
+    newLastName  := c.DefaultPostForm("last_name", lastName)
+    newEmail     := strings.TrimSpace(c.DefaultPostForm("email", email))
+
+    // an empty display name goes back to the default
+    newDisplayName := displayName
+    if name, ok := c.GetPostForm("display_name"); ok {
+        newDisplayName = sql.NullString{String: name, Valid: name != ""}
+    }
+
+    newShowRealName := showRealName
+    if show, ok := c.GetPostForm("show_real_name"); ok {
+        if newShowRealName, err = strconv.ParseBool(show); err != nil {
+            c.JSON(400, gin.H{"error": "invalid privacy setting"})
+            return
+        }
+    }
+
+    // check lengths of names
+    if len(newFirstName) < 1 || len(newLastName) < 1 {
+        c.JSON(400, gin.H{"error": "name is not valid"})
+        return
+    }
+
+    // check email address
+    re := regexp.MustCompile(EmailAddrRegex)
+    if !re.Match([]byte(newEmail)) {
+        c.JSON(400, gin.H{"error": "invalid email address"})
+        return
+    }
+
+    // the address is where password resets go, so a stolen session alone
+    // isn't enough to change it
+    if newEmail != email {
+        problem, err := confirmUser(userId, token,
+                                    c.PostForm("current_password"),
+                                    "change your email address")
+        if err != nil {
+            c.JSON(500, gin.H{"error": "unexpected error occurred"})
+            return
+        }
+
+        if problem != "" {
+            c.JSON(403, gin.H{"error": problem})
+            return
+        }
+    }
+
+    // check display name, unless unchanged so moderation can tighten rules
+    // without locking users out of editing their profile
+    if newDisplayName.Valid && newDisplayName != displayName {
+        if problem := checkDisplayName(newDisplayName.String); problem != "" {
+            c.JSON(400, gin.H{"error": problem})
+            return
+        }
+    }
+
+    // a new address has to be verified again
+    _, err = stores.sqlPool.Exec(
+        "UPDATE webapp.user SET first_name=$1, last_name=$2, email=$3, " +
+        "email_verified=(email_verified AND lower(email)=lower($3)), " +
+        "display_name=$4, " +
+        "show_real_name=$5 WHERE user_id=$6",
+        newFirstName, newLastName, newEmail, newDisplayName,
+        newShowRealName, userId)
+    if isDisplayNameTaken(err) {
+        c.JSON(400, gin.H{"error": "display name is already taken"})
+        return
+    } else if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == pqUniqueViolation {
+        c.JSON(400, gin.H{"error": "email address is already in use"})
+        return
+    } else if err != nil {
+        c.JSON(500, gin.H{"error": "unexpected error occurred"})
+        return
+    }
+
+    if !strings.EqualFold(newEmail, email) {
+        if err = sendEmailChangedMail(email, newEmail); err != nil {
+            log.Println("failed to send email changed notice:", err)
+        }
+        if err = sendVerifyMail(userId, newEmail); err != nil {
+            log.Println("failed to send verification mail:", err)
+        }
+        c.JSON(200, gin.H{"message": "profile has been updated, please " +
+                                     "verify your new email address"})
+        return
+    }
+
+    c.JSON(200, gin.H{"message": "profile has been updated"})
+}
+
+func handleChangePassword(c *gin.Context) {
+    // get userid of logged in user, abort if 0
+    userId, token := getLoggedInUser(c)
+    if userId <= 0 {
+        c.JSON(401, gin.H{"error": "not logged in"})
+        return
+    }
+
+    currentPassword := c.PostForm("current_password")
+    password        := c.PostForm("password")
+    if len(password) < 1 {
+        c.JSON(400, gin.H{"error": "password is missing"})
+        return
+    }
+
+    var passwordHash []byte
+    err := stores.sqlPool.QueryRow(
+        "SELECT password FROM webapp.user WHERE user_id=$1",
+        userId).Scan(&passwordHash)
+    if err != nil {
+        c.JSON(500, gin.H{"error": "unexpected error occurred"})
+        return
+    }
+
+    // accounts created through a login provider have no password yet
+    if len(passwordHash) == 0 {
+        c.JSON(400, gin.H{"error": "no password is set, use forgotten " +
+                                   "password to choose one"})
+        return
+    }
+
+    err = bcrypt.CompareHashAndPassword(passwordHash, []byte(currentPassword))
+    if err != nil {
+        c.JSON(400, gin.H{"error": "current password is incorrect"})
+        return
+    }
+
+    // bcrypt password
+    hash, err := bcrypt.GenerateFromPassword([]byte(password), BcryptCostFactor)
+    if err != nil {
+        c.JSON(500, gin.H{"error": "an error occurred, please try again"})
+        return
+    }
+
+    _, err = stores.sqlPool.Exec(
+        "UPDATE webapp.user SET password=$1 WHERE user_id=$2", hash, userId)
+    if err != nil {
+        c.JSON(500, gin.H{"error": "an error occurred, please try again"})
+        return
+    }
+
+    // log out everywhere else and give this device a fresh session
+    if err = deleteUserSessions(userId); err != nil {
+        log.Println("failed to delete sessions after password change:", err)
+    }
+    if !rotateUserSession(c, userId, token) {
+        http.SetCookie(c.Writer, createSessionCookie("", -1))
+        c.JSON(200, gin.H{"message": "password has been changed, please login"})
+        return
+    }
+
+    c.JSON(200, gin.H{"message": "password has been changed"})
+}
+
+func handleDeleteAccount(c *gin.Context) {
+    // get userid of logged in user, abort if 0
+    userId, token := getLoggedInUser(c)
+    if userId <= 0 {
+        c.JSON(401, gin.H{"error": "not logged in"})
+        return
+    }
+
+    // a stolen session alone isn't enough to delete the account
+    password := deleteRequestForm(c).Get("password")
+    problem, err := confirmUser(userId, token, password,
+                                "delete your account")
+    if err != nil {
+        c.JSON(500, gin.H{"error": "unexpected error occurred"})
+        return
+    }
+
+    if problem != "" {
+        c.JSON(403, gin.H{"error": problem})
+        return
+    }
+
+    tx, err := stores.sqlPool.Begin()
+    if err != nil {
+        c.JSON(500, gin.H{"error": "unexpected error occurred"})
+        return
+    }
+    defer tx.Rollback()
+
+    // remove rows referring to the user, then the user, progress goes with
+    // the user as its history refuses to be deleted any other way
+    _, err = tx.Exec("DELETE FROM webapp.api_token WHERE user_id=$1", userId)
+    if err == nil {
+        _, err = tx.Exec("DELETE FROM webapp.user_identity WHERE user_id=$1",
+                         userId)
+    }
+
+    var email string
+    if err == nil {
+        err = tx.QueryRow(
+            "DELETE FROM webapp.user WHERE user_id=$1 RETURNING email",
+            userId).Scan(&email)
+    }
+    if err == nil {
+        err = tx.Commit()
+    }
+    if err != nil {
+        c.JSON(500, gin.H{"error": "account could not be deleted, " +
+                                   "please try again"})
+        return
+    }
+
+    // the account is gone, anything left in redis is only logged
+    err = eraseUserRedisData(userId, email)
+    if err != nil {
+        log.Println("failed to erase redis data of deleted user " +
+                    strconv.Itoa(userId) + ":", err)
+    }
+
+    http.SetCookie(c.Writer, createSessionCookie("", -1))
+    c.JSON(200, gin.H{"message": "account has been deleted"})
+}
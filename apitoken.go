@@ -0,0 +1,256 @@
+package main
+
+import (
+  "encoding/base64"
+  "strconv"
+  "strings"
+  "time"
+  "github.com/gin-gonic/gin"
+)
+
+/******************************************************************************
+ * Constants
+ *****************************************************************************/
+
+const (
+    ApiTokenPrefix     string = "fmt_"
+    ApiTokenBytes      int    = 32
+    ApiTokenNameLength int    = 64
+    ApiTokenMaxCount   int    = 20
+    tokenScopeKey      string = "tokenScope"
+)
+
+// what an api token may be used for, each route accepting tokens names one
+const (
+    ScopeProfile     string = "profile"
+    ScopeProgress    string = "progress"
+    ScopeLeaderboard string = "leaderboard"
+    ScopeLobby       string = "lobby"
+)
+
+/******************************************************************************
+ * Type Declarations
+ *****************************************************************************/
+
+// an api token as shown to its owner, the token itself is only shown once
+type ApiToken struct {
+    Id       int        `json:"id"`
+    Name     string     `json:"name"`
+    Scopes   []string   `json:"scopes"`
+    Created  time.Time  `json:"created"`
+    LastUsed *time.Time `json:"lastUsed"`
+}
+
+/******************************************************************************
+ * Global Variables
+ *****************************************************************************/
+
+var apiTokenScopes []string = []string{ScopeProfile, ScopeProgress,
+                                       ScopeLeaderboard, ScopeLobby}
+
+/******************************************************************************
+ * Helper functions
+ *****************************************************************************/
+
+// bearer token sent with the request, empty if there isn't one
+func getBearerToken(c *gin.Context) string {
+    header := c.GetHeader("Authorization")
+    if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+        return ""
+    }
+
+    return strings.TrimSpace(header[7:])
+}
+
+// hash of an api token, empty if it isn't one of ours
+func apiTokenHash(token string) string {
+    if !strings.HasPrefix(token, ApiTokenPrefix) {
+        return ""
+    }
+
+    bytes, err := base64.URLEncoding.DecodeString(token[len(ApiTokenPrefix):])
+    if err != nil || len(bytes) != ApiTokenBytes {
+        return ""
+    }
+
+    return hashToken(bytes)
+}
+
+// return the user an api token belongs to if it grants scope, 0 otherwise
+func getApiTokenUser(token string, scope string) int {
+    tokenHash := apiTokenHash(token)
+    if tokenHash == "" || scope == "" {
+        return 0
+    }
+
+    var userId int
+    var scopes string
+    err := stores.sqlPool.QueryRow(
+        "UPDATE webapp.api_token SET last_used=NOW() " +
+        "WHERE token_hash=$1 RETURNING user_id, scopes",
+        tokenHash).Scan(&userId, &scopes)
+    if err != nil {
+        return 0
+    }
+
+    for _, granted := range strings.Fields(scopes) {
+        if granted == scope {
+            return userId
+        }
+    }
+
+    return 0
+}
+
+// every api token of a user, oldest first
+func listApiTokens(userId int) ([]ApiToken, error) {
+    rows, err := stores.sqlPool.Query(
+        "SELECT token_id, name, scopes, created, last_used " +
+        "FROM webapp.api_token WHERE user_id=$1 ORDER BY created", userId)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    tokens := []ApiToken{}
+    for rows.Next() {
+        var token ApiToken
+        var scopes string
+        err = rows.Scan(&token.Id, &token.Name, &scopes,
+                        &token.Created, &token.LastUsed)
+        if err != nil {
+            return nil, err
+        }
+
+        token.Scopes = strings.Fields(scopes)
+        tokens = append(tokens, token)
+    }
+
+    return tokens, rows.Err()
+}
+
+// keep the known scopes asked for, in a fixed order without duplicates
+func parseTokenScopes(requested []string) []string {
+    scopes := []string{}
+    for _, scope := range apiTokenScopes {
+        for _, r := range requested {
+            if r == scope {
+                scopes = append(scopes, scope)
+                break
+            }
+        }
+    }
+
+    return scopes
+}
+
+/******************************************************************************
+ * Middleware
+ *****************************************************************************/
+
+// let api tokens granting scope authenticate the route, routes without a
+// scope only accept the session cookie
+func TokenScope(scope string) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        c.Set(tokenScopeKey, scope)
+    }
+}
+
+/******************************************************************************
+ * Handlers
+ *****************************************************************************/
+
+func handleListTokens(c *gin.Context) {
+    // get userid of logged in user, abort if 0
+    userId, _ := getLoggedInUser(c)
+    if userId <= 0 {
+        c.JSON(401, gin.H{"error": "not logged in"})
+        return
+    }
+
+    tokens, err := listApiTokens(userId)
+    if err != nil {
+        c.JSON(500, gin.H{"error": "unexpected error occurred"})
+        return
+    }
+
+    c.JSON(200, tokens)
+}
+
+func handleCreateToken(c *gin.Context) {
+    // get userid of logged in user, abort if 0
+    userId, _ := getLoggedInUser(c)
+    if userId <= 0 {
+        c.JSON(401, gin.H{"error": "not logged in"})
+        return
+    }
+
+    name := strings.TrimSpace(c.PostForm("name"))
+    if len(name) < 1 || len(name) > ApiTokenNameLength {
+        c.JSON(400, gin.H{"error": "name is not valid"})
+        return
+    }
+
+    scopes := parseTokenScopes(c.PostFormArray("scope"))
+    if len(scopes) == 0 {
+        c.JSON(400, gin.H{"error": "at least one valid scope is required",
+                          "scopes": apiTokenScopes})
+        return
+    }
+
+    bytes, err := generateRandomId(ApiTokenBytes)
+    if err != nil {
+        c.JSON(500, gin.H{"error": "unexpected error occurred"})
+        return
+    }
+
+    // only store the hash, as with sessions, limiting tokens per user
+    var tokenId int
+    err = stores.sqlPool.QueryRow(
+        "INSERT INTO webapp.api_token(user_id, name, scopes, token_hash, " +
+                                     "created) " +
+        "SELECT $1, $2, $3, $4, NOW() " +
+        "WHERE (SELECT COUNT(*) FROM webapp.api_token WHERE user_id=$1) < $5 " +
+        "RETURNING token_id",
+        userId, name, strings.Join(scopes, " "), hashToken(bytes),
+        ApiTokenMaxCount).Scan(&tokenId)
+    if err != nil {
+        c.JSON(400, gin.H{"error": "token could not be created, please " +
+                                   "revoke unused tokens and try again"})
+        return
+    }
+
+    token := ApiTokenPrefix + base64.URLEncoding.EncodeToString(bytes)
+    c.JSON(200, gin.H{"id": tokenId, "name": name, "scopes": scopes,
+                      "token": token})
+}
+
+func handleRevokeToken(c *gin.Context) {
+    // get userid of logged in user, abort if 0
+    userId, _ := getLoggedInUser(c)
+    if userId <= 0 {
+        c.JSON(401, gin.H{"error": "not logged in"})
+        return
+    }
+
+    tokenId, err := strconv.Atoi(c.Param("token"))
+    if err != nil {
+        c.JSON(404, gin.H{"error": "token not found"})
+        return
+    }
+
+    r, err := stores.sqlPool.Exec(
+        "DELETE FROM webapp.api_token WHERE token_id=$1 AND user_id=$2",
+        tokenId, userId)
+    if err != nil {
+        c.JSON(500, gin.H{"error": "unexpected error occurred"})
+        return
+    }
+
+    if rows, _ := r.RowsAffected(); rows != 1 {
+        c.JSON(404, gin.H{"error": "token not found"})
+        return
+    }
+
+    c.JSON(200, gin.H{"message": "token has been revoked"})
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+  "bytes"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "io/fs"
+  "log"
+  "regexp"
+  "sort"
+  "strings"
+  "github.com/gin-gonic/gin"
+)
+
+/******************************************************************************
+ * Constants
+ *****************************************************************************/
+
+const (
+    AssetsDir             string = "assets"
+    IndexPath             string = "index.html"
+    AssetHashLen          int    = 10
+    ImmutableCacheControl string = "public, max-age=31536000, immutable"
+    requireScriptTag      string = "<script data-main="
+)
+
+/******************************************************************************
+ * Global Variables
+ *****************************************************************************/
+
+var (
+    // content hash of every file under assets, keyed by path relative to it
+    assetHashes map[string]string = make(map[string]string)
+
+    // digest of every asset hash, changes whenever any asset does
+    assetVersion string
+
+    // index page with fingerprinted asset references, and its entity tag
+    indexPage []byte
+    indexETag string
+)
+
+// asset references in index.html attributes
+var assetRefRegex *regexp.Regexp =
+    regexp.MustCompile(`((?:href|src)=["'])` + AssetsDir + `/([^"'?]+)(["'])`)
+
+/******************************************************************************
+ * Helper functions
+ *****************************************************************************/
+
+// hash every asset and build the index page from the site files
+func loadAssets() {
+    err := fs.WalkDir(siteFiles, AssetsDir,
+                      func(name string, entry fs.DirEntry, err error) error {
+        if err != nil || entry.IsDir() {
+            return err
+        }
+
+        raw, err := fs.ReadFile(siteFiles, name)
+        if err != nil {
+            return err
+        }
+
+        // hash contents, keyed by path inside assets
+        sum := sha256.Sum256(raw)
+        relative := strings.TrimPrefix(name, AssetsDir + "/")
+        assetHashes[relative] = hex.EncodeToString(sum[:])[:AssetHashLen]
+        return nil
+    })
+    if err != nil {
+      log.Fatal("Failed to fingerprint assets.")
+    }
+
+    // combine hashes in a fixed order
+    names := make([]string, 0, len(assetHashes))
+    for name := range assetHashes {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+    manifest := sha256.New()
+    for _, name := range names {
+        manifest.Write([]byte(name + " " + assetHashes[name] + "\n"))
+    }
+    assetVersion = hex.EncodeToString(manifest.Sum(nil))[:AssetHashLen]
+
+    raw, err := fs.ReadFile(siteFiles, IndexPath)
+    if err != nil {
+      log.Fatal("Failed to read index file.")
+    }
+
+    indexPage = fingerprintIndex(raw)
+    sum := sha256.Sum256(indexPage)
+    indexETag = "\"" + hex.EncodeToString(sum[:])[:AssetHashLen] + "\""
+}
+
+// returns the url of an asset including its content hash
+func fingerprintedURL(name string) string {
+    if hash, ok := assetHashes[name]; ok {
+        return AssetsDir + "/" + name + "?v=" + hash
+    }
+
+    return AssetsDir + "/" + name
+}
+
+// rewrite asset references in the index page to their fingerprinted urls and
+// have requirejs do the same for every module it loads
+func fingerprintIndex(raw []byte) []byte {
+    page := assetRefRegex.ReplaceAllFunc(raw, func(match []byte) []byte {
+        parts := assetRefRegex.FindSubmatch(match)
+        url := fingerprintedURL(string(parts[2]))
+        return []byte(string(parts[1]) + url + string(parts[3]))
+    })
+
+    // requirejs module urls are relative to the page, as in main.js baseUrl
+    modules := make(map[string]string)
+    for name, hash := range assetHashes {
+        if strings.HasSuffix(name, ".js") {
+            modules[AssetsDir + "/" + name] = hash
+        }
+    }
+    hashes, _ := json.Marshal(modules)
+
+    // global config read by requirejs when it loads, appending the hash
+    config := "<script>var require = {urlArgs: function(id, url) {" +
+              "var v = " + string(hashes) + "[url.split('?')[0]];" +
+              "return v ? (url.indexOf('?') < 0 ? '?' : '&') + 'v=' + v : '';" +
+              "}};</script>\n    "
+    return bytes.Replace(page, []byte(requireScriptTag),
+                         []byte(config + requireScriptTag), 1)
+}
+
+/******************************************************************************
+ * Handlers
+ *****************************************************************************/
+
+// assets requested with their current hash never change, anything else may
+func FingerprintCacheControl(c *gin.Context) {
+    name := strings.TrimPrefix(c.Request.URL.Path, "/" + AssetsDir + "/")
+    hash, ok := assetHashes[name]
+    if ok && c.Query("v") == hash {
+        c.Header("Cache-Control", ImmutableCacheControl)
+    } else {
+        c.Header("Cache-Control", AssetCacheControl)
+    }
+}
+
+func handleIndex(c *gin.Context) {
+    c.Header("ETag", indexETag)
+    if etagMatches(c.GetHeader("If-None-Match"), indexETag) {
+        c.AbortWithStatus(304)
+        return
+    }
+
+    c.Data(200, "text/html; charset=utf-8", indexPage)
+}
@@ -4,14 +4,26 @@ function($) {
     ping:           "ping",
 
     stars:          "stars",
+    cultures:       "cultures",
     constellations: "constellations",
     families:       "families",
+    asterisms:      "asterisms",
 
     profile:        "user/profile",
     progress:       "user/progress",
     login:          "user/login",
     logout:         "user/logout",
+    sessions:       "user/sessions",
+    tokens:         "user/tokens",
     register:       "user/register",
+    loginProviders: "user/oidc",
+    account:        "user",
+    password:       "user/password",
+    export:         "user/export",
+    passwordForgot: "user/password/forgot",
+    passwordReset:  "user/password/reset",
+    verify:         "user/verify",
+    verifyResend:   "user/verify/resend",
     leaderboard:    "leaderboard",
 
     lobbyStatus:    "lobby/status",
@@ -21,17 +33,50 @@ function($) {
     lobbyFinish:    "lobby/finish"
   };
 
+  // token the server expects echoed back on requests which change state
+  const csrfToken = () => {
+    const match = document.cookie.match(/(?:^|;\s*)FIRMAMENT_CSRF=([^;]*)/);
+    return match ? decodeURIComponent(match[1]) : "";
+  };
+
+  $.ajaxSetup({
+    beforeSend: (xhr, settings) => {
+      if (!/^(GET|HEAD|OPTIONS)$/i.test(settings.type)) {
+        xhr.setRequestHeader("X-CSRF-Token", csrfToken());
+      }
+    }
+  });
+
   return {
     starsGET: () => { return $.getJSON(urls.stars); },
+    culturesGET: () => { return $.getJSON(urls.cultures); },
     constellationsGET: () => { return $.getJSON(urls.constellations); },
     familiesGET: () => { return $.getJSON(urls.families); },
+    asterismsGET: () => { return $.getJSON(urls.asterisms); },
     profileGET: () => { return $.getJSON(urls.profile); },
+    profilePATCH: (data) => { return $.ajax({url: urls.profile, type: "PATCH", data: data}); },
+    passwordPOST: (current, password) => { return $.post(urls.password, {current_password: current, password: password}); },
+    exportURL: (format) => { return urls.export + (format ? "?format=" + format : ""); },
+    accountDELETE: (password) => { return $.ajax({url: urls.account, type: "DELETE", data: {password: password}}); },
     leaderboardGET: () => { return $.getJSON(urls.leaderboard); },
 
+    learnedGET: () => { return $.getJSON(urls.progress); },
     progressPOST: (family, value) => { return $.post(urls.progress + "/" + family, {progress: value}); },
     loginPOST: (data) => { return $.post(urls.login, data); },
     logoutPOST: (data) => { return $.post(urls.logout, data); },
+    sessionsGET: () => { return $.getJSON(urls.sessions); },
+    sessionDELETE: (id) => { return $.ajax({url: urls.sessions + "/" + encodeURIComponent(id), type: "DELETE"}); },
+    sessionsDELETE: () => { return $.ajax({url: urls.sessions, type: "DELETE"}); },
+    tokensGET: () => { return $.getJSON(urls.tokens); },
+    tokensPOST: (name, scopes) => { return $.post(urls.tokens, $.param({name: name, scope: scopes}, true)); },
+    tokenDELETE: (id) => { return $.ajax({url: urls.tokens + "/" + id, type: "DELETE"}); },
     registerPOST: (data) => { return $.post(urls.register, data); },
+    loginProvidersGET: () => { return $.getJSON(urls.loginProviders); },
+    loginProviderURL: (id) => { return urls.loginProviders + "/" + encodeURIComponent(id) + "/login"; },
+    forgotPasswordPOST: (email) => { return $.post(urls.passwordForgot, {email: email}); },
+    verifyPOST: (token) => { return $.post(urls.verify, {token: token}); },
+    verifyResendPOST: () => { return $.post(urls.verifyResend); },
+    resetPasswordPOST: (token, password) => { return $.post(urls.passwordReset, {token: token, password: password}); },
     leaderboardPOST: (data) => { return $.post(urls.leaderboard, {score: score}); },
 
     lobbyStatusGET: (lobbyId) => { return $.getJSON(urls.lobbyStatus + "/" + lobbyId); },
@@ -36,6 +36,39 @@ function($, FAPI, FEVENT, FMODEL, FGUI, FVIEW) {
     }); 
   }
 
+  function onForgotSubmit(event) {
+    FAPI.forgotPasswordPOST(event.email).success(function(response) {
+      event.success(response.message);
+    }).fail(function(response) {
+      event.fail(response.responseJSON.error);
+    });
+  }
+
+  function onResetSubmit(event) {
+    FAPI.resetPasswordPOST(event.token, event.password).success(function(response) {
+      event.success(response.message);
+    }).fail(function(response) {
+      event.fail(response.responseJSON.error);
+    });
+  }
+
+  function onVerifyEmail(event) {
+    FAPI.verifyPOST(event.token).success(function(response) {
+      FMODEL.refreshUserProfile();
+      event.success(response.message);
+    }).fail(function(response) {
+      event.fail(response.responseJSON.error);
+    });
+  }
+
+  function onVerifyResend(event) {
+    FAPI.verifyResendPOST().success(function(response) {
+      event.success(response.message);
+    }).fail(function(response) {
+      event.fail(response.responseJSON.error);
+    });
+  }
+
   function onToggleButtonClick(event) {
     FMODEL.toggleVisibility(event.button);
   }
@@ -240,8 +273,12 @@ function($, FAPI, FEVENT, FMODEL, FGUI, FVIEW) {
         FEVENT.on('settingssubmit', onSettingsSubmit);
         FEVENT.on('loginsubmit',    onLoginSubmit);
         FEVENT.on('registersubmit', onRegisterSubmit);
+        FEVENT.on('forgotsubmit',   onForgotSubmit);
+        FEVENT.on('resetsubmit',    onResetSubmit);
 
         FEVENT.on('logoutsubmit', onLogoutSubmit);
+        FEVENT.on('verifyemail',  onVerifyEmail);
+        FEVENT.on('verifyresend', onVerifyResend);
 
         FEVENT.on('challengestart', onChallengeStart);
         FEVENT.on('challengemulticreate', onChallengeMultiCreate);
@@ -259,6 +296,8 @@ function($, FAPI, FEVENT, FMODEL, FGUI, FVIEW) {
         FEVENT.on('quizsetup', onQuizSetup);
 
         FEVENT.on('challengefinishevent', onChallengeFinish);
+
+        FGUI.handleEmailLinks();
       });
     }
   };
@@ -32,6 +32,11 @@ function($, FEVENT, FMODEL, Moment, Mustache) {
         $("#login").modal("show");
         return false;
       });
+      $('a[href*="#forgot"]').click(function() {
+        $(".modal.in").modal("hide");
+        $("#forgot").modal("show");
+        return false;
+      });
       $('a[href*="#skyset"]').click(function() {
         $(".modal.in").modal("hide");
         $("#skyset").modal("show");
@@ -223,6 +228,52 @@ function($, FEVENT, FMODEL, Moment, Mustache) {
         FEVENT.fire('loginsubmit', evt);
       });
 
+      $("#forgot-form").submit(function() {
+        event.preventDefault();
+        var evt = {
+          email: $(this).find("[name=email]").val(),
+          success: function(message) {
+            $("#forgot-error").empty().hide();
+            $("#forgot-form")[0].reset();
+            renderNotice("Reset your password", message);
+          },
+          fail: function(reason) {
+            $("#forgot-error").html('<p>' + reason + '</p>').show();
+          }
+        };
+        FEVENT.fire('forgotsubmit', evt);
+      });
+
+      $("#reset-form").submit(function() {
+        event.preventDefault();
+        var evt = {
+          token:    $(this).find("[name=token]").val(),
+          password: $(this).find("[name=password]").val(),
+          success: function(message) {
+            $("#reset-error").empty().hide();
+            $("#reset-form")[0].reset();
+            renderNotice("Password reset", message);
+          },
+          fail: function(reason) {
+            $("#reset-error").html('<p>' + reason + '</p>').show();
+          }
+        };
+        FEVENT.fire('resetsubmit', evt);
+      });
+
+      $("#verify-resend").click(function() {
+        event.preventDefault();
+        var evt = {
+          success: function(message) {
+            renderNotice("Verify your email", message);
+          },
+          fail: function(reason) {
+            renderNotice("Verify your email", reason);
+          }
+        };
+        FEVENT.fire('verifyresend', evt);
+      });
+
       $("#user-logout").click(function() {
         event.preventDefault();
         var evt = {
@@ -235,6 +286,48 @@ function($, FEVENT, FMODEL, Moment, Mustache) {
     });
   }
 
+  // links sent by email carry a token to act on once the page loads, called
+  // once the controller listens for the events fired
+  function handleEmailLinks() {
+    var params = new URLSearchParams(window.location.search);
+    if (params.has("verify")) {
+      var evt = {
+        token: params.get("verify"),
+        success: function(message) {
+          renderNotice("Email verified", message);
+        },
+        fail: function(reason) {
+          renderNotice("Verification failed", reason);
+        }
+      };
+      FEVENT.fire('verifyemail', evt);
+    }
+    if (params.has("reset")) {
+      $("#reset-form [name=token]").val(params.get("reset"));
+      $(".modal.in").modal("hide");
+      $("#reset").modal("show");
+    }
+    clearLinkTokens(params);
+  }
+
+  // remove tokens from the address bar so they don't end up in history
+  function clearLinkTokens(params) {
+    if (params.has("verify") || params.has("reset")) {
+      params.delete("verify");
+      params.delete("reset");
+      var query = params.toString();
+      window.history.replaceState(null, "", window.location.pathname +
+        (query.length ? "?" + query : "") + window.location.hash);
+    }
+  }
+
+  function renderNotice(title, message) {
+    $(".modal.in").modal("hide");
+    $("#notice-title").text(title);
+    $("#notice-body").empty().append($("<p>").text(message));
+    $("#notice").modal("show");
+  }
+
   function getJoinId() {
     var hash = window.location.hash;
     if (hash.length == 16 && hash.substring(0, 8) == "#!/join/") {
@@ -263,6 +356,7 @@ function($, FEVENT, FMODEL, Moment, Mustache) {
       }
  
       $("#user-name").html(FMODEL.getUserName());
+      $("#verify-resend").toggle(!FMODEL.isEmailVerified());
 
       // show sidebar automatically when logged in
       $("#signin").hide();
@@ -381,8 +475,8 @@ function($, FEVENT, FMODEL, Moment, Mustache) {
     var template = $("#lobby-start").html();
     var players = [];
 
-    $.each(lobby.scores, function(k, v) {
-      players.push({player: k, status: "ready"});
+    $.each(lobby.players, function(i, p) {
+      players.push({player: p.name, status: "ready"});
     });
 
     var data = {
@@ -401,11 +495,11 @@ function($, FEVENT, FMODEL, Moment, Mustache) {
     var template = $("#lobby-results").html();
     var players = [];
 
-    $.each(lobby.scores, function(k, v) {
-      if (v < 0) {
-        players.push({player: k, score: "still playing..."});
+    $.each(lobby.players, function(i, p) {
+      if (p.score < 0) {
+        players.push({player: p.name, score: "still playing..."});
       } else {
-        players.push({player: k, score: v});
+        players.push({player: p.name, score: p.score});
       }
     });
 
@@ -487,6 +581,8 @@ function($, FEVENT, FMODEL, Moment, Mustache) {
     renderChallengeLobbyQuestion: renderChallengeLobbyQuestion,
     renderLobbyResults: renderLobbyResults,
 
-    renderLeaderboard: renderLeaderboard
+    renderLeaderboard: renderLeaderboard,
+    renderNotice:      renderNotice,
+    handleEmailLinks:  handleEmailLinks
   };
 });
@@ -170,6 +170,10 @@ function($, FAPI, FEVENT, ASTRO, FQUIZ) {
     return profile.loggedIn;
   }
 
+  function isEmailVerified() {
+    return profile.emailVerified;
+  }
+
   function getUserName() {
     return profile.firstName + " " + profile.lastName;
   }
@@ -329,6 +333,7 @@ function($, FAPI, FEVENT, ASTRO, FQUIZ) {
 
     isUserLoggedIn: isUserLoggedIn,
     getUserName: getUserName,
+    isEmailVerified: isEmailVerified,
 
     progress: progress,
     familyProgress: familyProgress,
@@ -4,6 +4,30 @@ import (
   "github.com/gin-gonic/gin"
 )
 
+// returns the sky culture selected by the culture query parameter, responding
+// with 404 and returning false if it does not exist
+func getRequestCulture(c *gin.Context) (*SkyCulture, bool) {
+    culture, found := getSkyCulture(c.Query("culture"))
+    if !found {
+        c.JSON(404, gin.H{"error": "sky culture does not exist"})
+        return nil, false
+    }
+
+    return culture, true
+}
+
+// tags catalog responses with the catalog version, answering conditional
+// requests for the current version with 304
+func CatalogVersion(c *gin.Context) {
+    etag := "\"" + catalogVersion + "\""
+    c.Header("ETag", etag)
+    c.Header("X-Catalog-Version", catalogVersion)
+
+    if etagMatches(c.GetHeader("If-None-Match"), etag) {
+        c.AbortWithStatus(304)
+    }
+}
+
 // setup routes on base path /
 func baseRoutes(base *gin.RouterGroup) {
     // health check
@@ -13,8 +37,12 @@ func baseRoutes(base *gin.RouterGroup) {
         })
     })
 
+    // catalog routes are versioned
+    catalog := base.Group("/", CatalogVersion, CacheTTL(CatalogCacheTTL),
+                          CacheControl(CatalogCacheControl))
+
     // serve stars JSON
-    base.GET("/stars", func(c *gin.Context) {
+    catalog.GET("/stars", func(c *gin.Context) {
         stars, err := getStars()
         if err != nil {
             c.AbortWithError(500, err)
@@ -23,22 +51,64 @@ func baseRoutes(base *gin.RouterGroup) {
         }
     })
 
+    // serve list of available sky cultures
+    catalog.GET("/cultures", func(c *gin.Context) {
+        c.JSON(200, skyCultures)
+    })
+
     // serve constellations JSON
-    base.GET("/constellations", func(c *gin.Context) {
-        c.JSON(200, constellations)
+    catalog.GET("/constellations", func(c *gin.Context) {
+        if culture, found := getRequestCulture(c); found {
+            c.JSON(200, culture.Constellations)
+        }
+    })
+
+    // serve a single constellation with its stars, level and neighbours
+    catalog.GET("/constellations/:short", func(c *gin.Context) {
+        culture, found := getRequestCulture(c)
+        if !found {
+            return
+        }
+
+        constellation, found := culture.getConstellation(c.Param("short"))
+        if !found {
+            c.JSON(404, gin.H{"error": "constellation does not exist"})
+            return
+        }
+
+        c.JSON(200, culture.getConstellationDetail(constellation))
+    })
+
+    // serve adjacent constellations and routes between constellations
+    catalog.GET("/constellations/:short/neighbours", handleNeighbours)
+    catalog.GET("/constellations/:short/route/:target", handleStarHoppingRoute)
+
+    // serve asterisms JSON
+    catalog.GET("/asterisms", func(c *gin.Context) {
+        if culture, found := getRequestCulture(c); found {
+            c.JSON(200, culture.Asterisms)
+        }
     })
 
     // serve families JSON
-    base.GET("/families", func(c *gin.Context) {
-        c.JSON(200, families)
+    catalog.GET("/families", func(c *gin.Context) {
+        if culture, found := getRequestCulture(c); found {
+            c.JSON(200, culture.Families)
+        }
     })
 
-    // serve the index file on root
-    base.StaticFile("/", "index.html")
-    base.StaticFile("/index.html", "index.html")
+    // serve the index file with fingerprinted assets on root, always
+    // revalidated
+    index := base.Group("/", CacheControl(IndexCacheControl))
+    for _, path := range []string{"/", "/index.html"} {
+        index.GET(path, handleIndex)
+        index.HEAD(path, handleIndex)
+    }
 
-    // serve all asset files on /assets/
-    base.Static("/assets", "./assets")
+    // serve all asset files on /assets/, immutable when fingerprinted
+    assets := base.Group("/assets", CacheTTL(AssetCacheTTL),
+                         FingerprintCacheControl)
+    assets.StaticFS("/", assetFileSystem())
 
     // deployed version (will 404 locally)
     base.StaticFile("/version", "/var/webapp/version.txt")
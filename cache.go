@@ -1,15 +1,43 @@
 package main
 
 import (
-  "github.com/gin-gonic/gin"
-  "github.com/patrickmn/go-cache"
+  "container/list"
+  "crypto/sha256"
+  "encoding/hex"
   "net/http"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+  "github.com/gin-gonic/gin"
+)
+
+/******************************************************************************
+ * Constants
+ *****************************************************************************/
+
+const (
+    DefaultCacheTTL     time.Duration = 5 * time.Minute
+    CatalogCacheTTL     time.Duration = time.Hour
+    AssetCacheTTL       time.Duration = 24 * time.Hour
+    CacheMaxEntries     int           = 4096
+    CacheBudgetDefault  int           = 64
+    CoalesceTimeout     time.Duration = 10 * time.Second
+    CatalogCacheControl string        = "public, max-age=300"
+    AssetCacheControl   string        = "public, max-age=3600"
+    IndexCacheControl   string        = "no-cache"
+    cacheTTLKey         string        = "cacheTTL"
 )
 
+/******************************************************************************
+ * Type Declarations
+ *****************************************************************************/
+
 type responseData struct {
-    status int
-    header http.Header
-    data   []byte
+    status   int
+    header   http.Header
+    data     []byte
+    variants map[string][]byte
 }
 
 type cacheWriter struct {
@@ -19,82 +47,524 @@ type cacheWriter struct {
     blob    []byte
 }
 
+type inflightRequest struct {
+    done     chan struct{}
+    response *responseData
+}
+
+type cacheEntry struct {
+    key      string
+    path     string
+    response *responseData
+    expires  time.Time
+    size     int64
+}
+
+type CacheStats struct {
+    Entries   int    `json:"entries"`
+    Bytes     int64  `json:"bytes"`
+    MaxBytes  int64  `json:"maxBytes"`
+    Hits      uint64 `json:"hits"`
+    Misses    uint64 `json:"misses"`
+    Evictions uint64 `json:"evictions"`
+}
+
+// size bounded least recently used store for cached responses, entries expire
+// after their own ttl
+type ResponseCache struct {
+    mutex      sync.Mutex
+    entries    map[string]*list.Element
+    order      *list.List
+    maxEntries int
+    stats      CacheStats
+}
+
+/******************************************************************************
+ * Response writer
+ *****************************************************************************/
+
+// buffers the whole response so it can be compressed before being sent
 func newCacheWriter(writer gin.ResponseWriter) *cacheWriter {
-    return &cacheWriter{writer, 0, false, make([]byte, 0)}
+    return &cacheWriter{writer, http.StatusOK, false, make([]byte, 0)}
 }
 
 func (w *cacheWriter) WriteHeader(code int) {
     w.status = code
     w.written = true
-    w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *cacheWriter) WriteHeaderNow() {
+    w.written = true
 }
 
 func (w *cacheWriter) Status() int {
     return w.status
 }
 
+func (w *cacheWriter) Size() int {
+    return len(w.blob)
+}
+
 func (w *cacheWriter) Written() bool {
     return w.written
 }
 
 func (w *cacheWriter) Write(data []byte) (int, error) {
-    w.status = w.ResponseWriter.Status()
-    ret, err := w.ResponseWriter.Write(data)
-    if err == nil {
-        w.blob = append(w.blob, data...)
+    w.written = true
+    w.blob = append(w.blob, data...)
+    return len(data), nil
+}
+
+func (w *cacheWriter) WriteString(data string) (int, error) {
+    return w.Write([]byte(data))
+}
+
+// send the buffered response unchanged to the underlying writer
+func (w *cacheWriter) flushTo(writer gin.ResponseWriter) {
+    writer.WriteHeader(w.status)
+    writer.Write(w.blob)
+}
+
+/******************************************************************************
+ * Response store
+ *****************************************************************************/
+
+func NewResponseCache(maxEntries int, maxBytes int64) *ResponseCache {
+    return &ResponseCache{
+        entries:    make(map[string]*list.Element),
+        order:      list.New(),
+        maxEntries: maxEntries,
+        stats:      CacheStats{MaxBytes: maxBytes},
+    }
+}
+
+// approximate memory held by a response
+func responseSize(key string, response *responseData) int64 {
+    size := int64(len(key) + len(response.data))
+    for _, variant := range response.variants {
+        size += int64(len(variant))
+    }
+    for k, vals := range response.header {
+        size += int64(len(k))
+        for _, v := range vals {
+            size += int64(len(v))
+        }
+    }
+
+    return size
+}
+
+// change the memory budget, evicting entries if now over it
+func (store *ResponseCache) SetBudget(maxBytes int64) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    store.stats.MaxBytes = maxBytes
+    store.evict()
+}
+
+// returns the response cached under key if it has not expired
+func (store *ResponseCache) Get(key string) (*responseData, bool) {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    element, found := store.entries[key]
+    if !found {
+        store.stats.Misses++
+        return nil, false
+    }
+
+    entry := element.Value.(*cacheEntry)
+    if time.Now().After(entry.expires) {
+        store.remove(element)
+        store.stats.Misses++
+        return nil, false
+    }
+
+    store.order.MoveToFront(element)
+    store.stats.Hits++
+    return entry.response, true
+}
+
+// cache response under key for ttl, responses larger than the whole budget
+// are never stored
+func (store *ResponseCache) Set(key string, path string,
+                                response *responseData, ttl time.Duration) {
+    size := responseSize(key, response)
+
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    if size > store.stats.MaxBytes {
+        return
+    }
+
+    if element, found := store.entries[key]; found {
+        store.remove(element)
+    }
+
+    entry := cacheEntry{key, path, response, time.Now().Add(ttl), size}
+    store.entries[key] = store.order.PushFront(&entry)
+    store.stats.Bytes += size
+    store.evict()
+}
+
+// remove every entry whose request path starts with prefix, returning the
+// number of entries removed
+func (store *ResponseCache) Invalidate(prefix string) int {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    removed := 0
+    for _, element := range store.entries {
+        if strings.HasPrefix(element.Value.(*cacheEntry).path, prefix) {
+            store.remove(element)
+            removed++
+        }
+    }
+
+    return removed
+}
+
+// returns a snapshot of the store counters
+func (store *ResponseCache) Stats() CacheStats {
+    store.mutex.Lock()
+    defer store.mutex.Unlock()
+
+    stats := store.stats
+    stats.Entries = store.order.Len()
+    return stats
+}
+
+// when over bounds drop expired entries, then least recently used ones until
+// within bounds, must be called with the mutex held
+func (store *ResponseCache) evict() {
+    if !store.overBounds() {
+        return
+    }
+
+    now := time.Now()
+    for element := store.order.Back(); element != nil; {
+        previous := element.Prev()
+        if now.After(element.Value.(*cacheEntry).expires) {
+            store.remove(element)
+        }
+        element = previous
+    }
+
+    for store.overBounds() {
+        store.remove(store.order.Back())
+        store.stats.Evictions++
+    }
+}
+
+// must be called with the mutex held
+func (store *ResponseCache) overBounds() bool {
+    return store.order.Len() > store.maxEntries ||
+           store.stats.Bytes > store.stats.MaxBytes
+}
+
+// must be called with the mutex held
+func (store *ResponseCache) remove(element *list.Element) {
+    entry := element.Value.(*cacheEntry)
+    store.order.Remove(element)
+    delete(store.entries, entry.key)
+    store.stats.Bytes -= entry.size
+}
+
+/******************************************************************************
+ * Global Variables
+ *****************************************************************************/
+
+// responses currently being computed, keyed by cache key
+var inflight = struct {
+    mutex    sync.Mutex
+    requests map[string]*inflightRequest
+}{requests: make(map[string]*inflightRequest)}
+
+/******************************************************************************
+ * Invalidation
+ *****************************************************************************/
+
+var cacheInvalidationHooks []func(prefix string) = make([]func(string), 0)
+
+// register a function to be called whenever cached paths are invalidated
+func onCacheInvalidate(hook func(prefix string)) {
+    cacheInvalidationHooks = append(cacheInvalidationHooks, hook)
+}
+
+// remove cached responses for all paths starting with prefix
+func invalidateCache(prefix string) int {
+    removed := stores.responseStore.Invalidate(prefix)
+    for _, hook := range cacheInvalidationHooks {
+        hook(prefix)
+    }
+
+    return removed
+}
+
+/******************************************************************************
+ * Middleware
+ *****************************************************************************/
+
+// checks an If-None-Match header against an entity tag, using the weak
+// comparison required for conditional GET requests
+func etagMatches(header string, etag string) bool {
+    if header == "" || etag == "" {
+        return false
+    }
+
+    // compressed variants of the same entity carry a suffixed tag
+    etag = baseETag(strings.TrimPrefix(etag, "W/"))
+    for _, candidate := range strings.Split(header, ",") {
+        candidate = baseETag(strings.TrimPrefix(strings.TrimSpace(candidate),
+                                                "W/"))
+        if candidate == "*" || candidate == etag {
+            return true
+        }
+    }
+
+    return false
+}
+
+// evaluate the conditional headers of a request against the validators of a
+// response, If-None-Match takes precedence over If-Modified-Since
+func notModified(request *http.Request, header http.Header) bool {
+    if request.Method != "GET" && request.Method != "HEAD" {
+        return false
+    }
+
+    if match := request.Header.Get("If-None-Match"); match != "" {
+        return etagMatches(match, header.Get("ETag"))
+    }
+
+    since, err := http.ParseTime(request.Header.Get("If-Modified-Since"))
+    if err != nil {
+        return false
+    }
+
+    modified, err := http.ParseTime(header.Get("Last-Modified"))
+    return err == nil && !modified.After(since)
+}
+
+// give a response validators if its handler didn't, a strong tag from the
+// content and the time it was first cached
+func addValidators(response *responseData) {
+    if response.header.Get("ETag") == "" {
+        sum := sha256.Sum256(response.data)
+        etag := hex.EncodeToString(sum[:])[:CatalogVersionLen]
+        response.header.Set("ETag", "\"" + etag + "\"")
+    }
+
+    if response.header.Get("Last-Modified") == "" {
+        now := time.Now().UTC().Format(http.TimeFormat)
+        response.header.Set("Last-Modified", now)
+    }
+}
+
+// returns middleware setting the Cache-Control header of a route
+func CacheControl(directives string) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        c.Header("Cache-Control", directives)
+    }
+}
+
+// returns middleware setting how long responses of a route are cached for
+func CacheTTL(ttl time.Duration) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        c.Set(cacheTTLKey, ttl)
+    }
+}
+
+// write a cached response, or only its headers if the client already has it,
+// using the best compressed variant the client accepts
+func writeCachedResponse(c *gin.Context, response *responseData,
+                         cacheStatus string) {
+    c.Abort()
+    c.Set(encodedKey, true)
+
+    // replace any headers set so far with those of the cached response
+    header := c.Writer.Header()
+    for k := range header {
+        delete(header, k)
+    }
+    for k, vals := range response.header {
+        header[k] = append([]string(nil), vals...)
+    }
+    header.Set("X-Cache", cacheStatus)
+
+    // select body for the accepted encoding
+    data := response.data
+    if len(response.variants) > 0 {
+        header.Add("Vary", "Accept-Encoding")
+        encoding := negotiateEncoding(c.GetHeader("Accept-Encoding"),
+                                      response.variants)
+        if encoding != "" {
+            data = response.variants[encoding]
+            header.Del("Accept-Ranges")
+            header.Set("Content-Encoding", encoding)
+            header.Set("ETag", variantETag(header.Get("ETag"), encoding))
+        }
+    }
+    header.Set("Content-Length", strconv.Itoa(len(data)))
+
+    // cached entity is unchanged, send headers only
+    if notModified(c.Request, header) {
+        header.Del("Content-Length")
+        c.Status(http.StatusNotModified)
+        return
+    }
+
+    c.Status(response.status)
+    if c.Request.Method != "HEAD" {
+        c.Writer.Write(data)
+    }
+}
+
+// wait for an in flight request to finish, returning its response if it could
+// be cached and was ready before the timeout
+func waitForInflight(request *inflightRequest) (*responseData, bool) {
+    timer := time.NewTimer(CoalesceTimeout)
+    defer timer.Stop()
+
+    select {
+    case <-request.done:
+        return request.response, request.response != nil
+    case <-timer.C:
+        return nil, false
     }
-    return ret, err
 }
 
 func GinCache(c *gin.Context) {
-    // set the cache key for this request, cache IMS separately
-    cacheKey         := c.Request.Method + c.Request.URL.Path
-    cacheKeyProgress := "PROG" + c.Request.Method + c.Request.URL.Path
-    if c.Request.Header["If-Modified-Since"] != nil {
-       cacheKey = "IMS" + cacheKey
+    // set the cache key for this request including the query string, as it
+    // selects the sky culture, HEAD is answered from the GET response
+    method := c.Request.Method
+    if method == "HEAD" {
+        method = "GET"
     }
+    cacheKey := method + c.Request.URL.RequestURI()
 
     // check if already cached
-    response, found := stores.cacheStore.Get(cacheKey)
-    _, progress     := stores.cacheStore.Get(cacheKeyProgress)
+    response, found := stores.responseStore.Get(cacheKey)
     if found {
-        c.Abort()
-        c.Status(response.(*responseData).status)
-        for k, vals := range response.(*responseData).header {
-            if k == "X-Cache" {
-                continue;
-            }
-
-            for _, v := range vals {
-                c.Writer.Header().Add(k, v)
-            }
-        }
-        c.Writer.Header().Add("X-Cache", "HIT")
-        c.Writer.Write(response.(*responseData).data)
-    } else if !progress {
-        // set cache status (avoids race)
-        stores.cacheStore.Set(cacheKeyProgress, true, cache.NoExpiration)
-
-        // replace writer with our own
-        original := c.Writer
-        cached := newCacheWriter(c.Writer)
-        c.Writer = cached
-        c.Writer.Header().Add("X-Cache", "MISS")
-
-        // continue with other handlers, defer setting progress to false incase
-        // we crash during other handlers
-        defer func(){ stores.cacheStore.Delete(cacheKeyProgress) }()
-        c.Next()
-
-        // check if return code is cachable
-        if cached.status != 200 && cached.status != 304 {
-            c.Writer = original
-            return
+        writeCachedResponse(c, response, "HIT")
+        return
+    }
+
+    // a HEAD response has no body to cache, so its length and etag would
+    // differ from the GET, leave it to the handlers
+    if c.Request.Method == "HEAD" {
+        c.Header("X-Cache", "MISS")
+        return
+    }
+
+    // check if another request is already computing this response
+    inflight.mutex.Lock()
+    request, progress := inflight.requests[cacheKey]
+    if !progress {
+        request = &inflightRequest{done: make(chan struct{})}
+        inflight.requests[cacheKey] = request
+    }
+    inflight.mutex.Unlock()
+
+    // wait for the first request and share its response, if it can't be
+    // shared in time handle this request ourselves without caching
+    if progress {
+        if response, ok := waitForInflight(request); ok {
+            writeCachedResponse(c, response, "HIT")
         }
+        return
+    }
+
+    // replace writer with our own
+    original := c.Writer
+    cached := newCacheWriter(c.Writer)
+    c.Writer = cached
+
+    // defer restoring the writer and releasing waiting requests incase we
+    // crash during other handlers
+    defer func() {
+        c.Writer = original
+        inflight.mutex.Lock()
+        delete(inflight.requests, cacheKey)
+        inflight.mutex.Unlock()
+        close(request.done)
+    }()
 
-        // write data into store
-        data := responseData{cached.status, cached.Header(), cached.blob}
-        stores.cacheStore.Set(cacheKey, &data, cache.NoExpiration)
+    // another instance may have computed this response already
+    path := c.Request.URL.Path
+    response, ttl, found := stores.sharedStore.Get(path, cacheKey)
+    if found {
         c.Writer = original
+        stores.responseStore.Set(cacheKey, path, response, ttl)
+        request.response = response
+        writeCachedResponse(c, response, "HIT")
+        return
+    }
+
+    // continue with other handlers, hiding conditional headers so we always
+    // get the full response to cache then evaluate them ourselves
+    conditions := make(http.Header)
+    for _, name := range []string{"If-None-Match", "If-Modified-Since"} {
+        if values, ok := c.Request.Header[name]; ok {
+            conditions[name] = values
+            c.Request.Header.Del(name)
+        }
+    }
+    c.Next()
+    c.Writer = original
+    for name, values := range conditions {
+        c.Request.Header[name] = values
+    }
+
+    // check if return code is cachable
+    if cached.status != 200 {
+        c.Writer.Header().Set("X-Cache", "MISS")
+        cached.flushTo(c.Writer)
+        return
+    }
+
+    // use the route ttl if one was set
+    ttl = DefaultCacheTTL
+    if value, exists := c.Get(cacheTTLKey); exists {
+        ttl = value.(time.Duration)
     }
+
+    // compress, write data into stores and hand it to waiting requests
+    header := cached.Header().Clone()
+    header.Del("X-Cache")
+    data := responseData{cached.status, header, cached.blob, nil}
+    addValidators(&data)
+    data.variants = compressVariants(&data)
+    stores.responseStore.Set(cacheKey, path, &data, ttl)
+    stores.sharedStore.Set(path, cacheKey, &data, ttl)
+    request.response = &data
+    writeCachedResponse(c, &data, "MISS")
+}
+
+/******************************************************************************
+ * Handlers
+ *****************************************************************************/
+
+func handleCacheStats(c *gin.Context) {
+    c.JSON(200, stores.responseStore.Stats())
+}
+
+func handleCachePurge(c *gin.Context) {
+    // purge everything unless a path prefix is given
+    prefix := c.DefaultPostForm("path", "/")
+    removed := invalidateCache(prefix)
+    c.JSON(200, gin.H{"message": "cache purged", "purged": removed})
+}
+
+/******************************************************************************
+ * Router Group for /cache/*
+ *****************************************************************************/
+
+// setup /cache routes, only for admins as behind a proxy every request
+// would appear to come from the server itself
+func cacheRoutes(admin *gin.RouterGroup) {
+    admin.Use(RequireRole(RoleAdmin))
+    admin.GET("/stats", handleCacheStats)
+    admin.POST("/purge", handleCachePurge)
 }
@@ -0,0 +1,365 @@
+package main
+
+import (
+  "compress/gzip"
+  "io/ioutil"
+  "strings"
+  "github.com/DATA-DOG/go-sqlmock"
+  "github.com/andybalholm/brotli"
+  "github.com/stretchr/testify/assert"
+  "github.com/gin-gonic/gin"
+  "net/http"
+  "net/http/httptest"
+  "sync"
+  "sync/atomic"
+  "testing"
+  "time"
+)
+
+func TestResponseCacheBounds(t *testing.T) {
+    assert := assert.New(t)
+    store := NewResponseCache(2, 1 << 20)
+    response := &responseData{200, http.Header{}, []byte("data"), nil}
+
+    // least recently used entry is evicted once over the entry limit
+    store.Set("GET/a", "/a", response, time.Minute)
+    store.Set("GET/b", "/b", response, time.Minute)
+    store.Get("GET/a")
+    store.Set("GET/c", "/c", response, time.Minute)
+
+    _, foundA := store.Get("GET/a")
+    _, foundB := store.Get("GET/b")
+    assert.True(foundA)
+    assert.False(foundB)
+    assert.Equal(uint64(1), store.Stats().Evictions)
+
+    // responses larger than the budget are not stored
+    store.SetBudget(16)
+    store.Set("GET/d", "/d", &responseData{200, http.Header{},
+                                          make([]byte, 32), nil}, time.Minute)
+    _, foundD := store.Get("GET/d")
+    assert.False(foundD)
+    assert.True(store.Stats().Bytes <= 16)
+}
+
+func TestResponseCacheExpiry(t *testing.T) {
+    store := NewResponseCache(8, 1 << 20)
+    response := &responseData{200, http.Header{}, []byte("data"), nil}
+
+    store.Set("GET/a", "/a", response, -time.Second)
+    _, found := store.Get("GET/a")
+    assert.False(t, found)
+    assert.Equal(t, 0, store.Stats().Entries)
+}
+
+func TestResponseCacheInvalidate(t *testing.T) {
+    store := NewResponseCache(8, 1 << 20)
+    response := &responseData{200, http.Header{}, []byte("data"), nil}
+
+    store.Set("GET/constellations", "/constellations", response, time.Minute)
+    store.Set("GET/constellations/Ori", "/constellations/Ori", response,
+              time.Minute)
+    store.Set("GET/stars", "/stars", response, time.Minute)
+
+    assert.Equal(t, 2, store.Invalidate("/constellations"))
+    _, found := store.Get("GET/stars")
+    assert.True(t, found)
+}
+
+func TestGinCacheCoalescing(t *testing.T) {
+    // slow handler counting how many times it actually runs
+    var calls int32
+    gin.SetMode(gin.ReleaseMode)
+    r := gin.New()
+    r.Use(GinCache)
+    r.GET("/slow", func(c *gin.Context) {
+        atomic.AddInt32(&calls, 1)
+        time.Sleep(50 * time.Millisecond)
+        c.String(200, "done")
+    })
+
+    // concurrent misses for the same path share one computation
+    var wg sync.WaitGroup
+    bodies := make([]string, 20)
+    for i := range bodies {
+        wg.Add(1)
+        go func(i int) {
+            defer wg.Done()
+            req, _ := http.NewRequest("GET", "/slow", nil)
+            resp := httptest.NewRecorder()
+            r.ServeHTTP(resp, req)
+            bodies[i] = resp.Body.String()
+        }(i)
+    }
+    wg.Wait()
+
+    assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+    for _, body := range bodies {
+        assert.Equal(t, "done", body)
+    }
+}
+
+func TestGinCacheCompression(t *testing.T) {
+    assert := assert.New(t)
+    body := strings.Repeat("{\"name\":\"Orion\"}", 200)
+
+    gin.SetMode(gin.ReleaseMode)
+    r := gin.New()
+    r.Use(GinCache)
+    r.GET("/large", func(c *gin.Context) {
+        c.Data(200, "application/json; charset=utf-8", []byte(body))
+    })
+
+    // serve the same cached entry in each encoding
+    get := func(acceptEncoding string) *httptest.ResponseRecorder {
+        req, _ := http.NewRequest("GET", "/large", nil)
+        req.Header.Set("Accept-Encoding", acceptEncoding)
+        resp := httptest.NewRecorder()
+        r.ServeHTTP(resp, req)
+        return resp
+    }
+
+    resp := get("gzip, deflate, br")
+    assert.Equal("br", resp.Header().Get("Content-Encoding"))
+    assert.Equal("Accept-Encoding", resp.Header().Get("Vary"))
+    decoded, _ := ioutil.ReadAll(brotli.NewReader(resp.Body))
+    assert.Equal(body, string(decoded))
+
+    resp = get("gzip;q=1.0, br;q=0.5")
+    assert.Equal("gzip", resp.Header().Get("Content-Encoding"))
+    reader, err := gzip.NewReader(resp.Body)
+    assert.Nil(err)
+    decoded, _ = ioutil.ReadAll(reader)
+    assert.Equal(body, string(decoded))
+
+    resp = get("identity")
+    assert.Equal("", resp.Header().Get("Content-Encoding"))
+    assert.Equal("Accept-Encoding", resp.Header().Get("Vary"))
+    assert.Equal(body, resp.Body.String())
+}
+
+func TestSharedResponseEncoding(t *testing.T) {
+    assert := assert.New(t)
+    header := http.Header{"Content-Type": {"application/json"}}
+    variants := map[string][]byte{EncodingGzip: []byte("zipped")}
+    response := &responseData{200, header, []byte("data"), variants}
+
+    // responses survive the round trip through redis
+    raw, err := encodeResponse(response)
+    assert.Nil(err)
+    decoded, err := decodeResponse(raw)
+    assert.Nil(err)
+    assert.Equal(response, decoded)
+
+    // path prefixes are matched literally
+    assert.Equal("cache:/a\\*\\?", escapeGlob("cache:/a*?"))
+}
+
+func TestSharedCacheVersions(t *testing.T) {
+    assert := assert.New(t)
+    useTestStores(t)
+    response := &responseData{200, http.Header{}, []byte("old"), nil}
+
+    // builds with other catalogs or assets don't see each other's entries
+    old := &SharedCache{pool: stores.redisPool, version: "aaa-111"}
+    current := &SharedCache{pool: stores.redisPool, version: "aaa-222"}
+    old.Set("/assets/js/main.js", "key", response, time.Minute)
+    _, _, found := current.Get("/assets/js/main.js", "key")
+    assert.False(found)
+    _, _, found = old.Get("/assets/js/main.js", "key")
+    assert.True(found)
+
+    // but invalidation reaches every version
+    current.Set("/assets/js/main.js", "key", response, time.Minute)
+    current.Invalidate("/assets/")
+    _, _, found = old.Get("/assets/js/main.js", "key")
+    assert.False(found)
+    _, _, found = current.Get("/assets/js/main.js", "key")
+    assert.False(found)
+
+    // versions come from the loaded site
+    assert.Equal(catalogVersion + "-" + assetVersion,
+                 NewSharedCache(stores.redisPool).version)
+    assert.Len(assetVersion, AssetHashLen)
+}
+
+func TestCompress(t *testing.T) {
+    assert := assert.New(t)
+    body := strings.Repeat("{\"name\":\"Orion\"}", 200)
+
+    gin.SetMode(gin.ReleaseMode)
+    r := gin.New()
+    r.Use(Compress)
+    r.GET("/large", func(c *gin.Context) {
+        c.Data(200, "application/json; charset=utf-8", []byte(body))
+    })
+    r.GET("/archive", func(c *gin.Context) {
+        c.Data(200, "application/zip", []byte(body))
+    })
+    r.GET("/small", func(c *gin.Context) {
+        c.Data(200, "application/json; charset=utf-8", []byte("{}"))
+    })
+    cached := r.Group("/cached", GinCache)
+    cached.GET("/large", func(c *gin.Context) {
+        c.Data(200, "application/json; charset=utf-8", []byte(body))
+    })
+
+    get := func(path string, acceptEncoding string) *httptest.ResponseRecorder {
+        req, _ := http.NewRequest("GET", path, nil)
+        req.Header.Set("Accept-Encoding", acceptEncoding)
+        resp := httptest.NewRecorder()
+        r.ServeHTTP(resp, req)
+        return resp
+    }
+
+    // uncached routes are compressed too
+    resp := get("/large", "gzip")
+    assert.Equal("gzip", resp.Header().Get("Content-Encoding"))
+    assert.Equal("Accept-Encoding", resp.Header().Get("Vary"))
+    reader, err := gzip.NewReader(resp.Body)
+    assert.Nil(err)
+    decoded, _ := ioutil.ReadAll(reader)
+    assert.Equal(body, string(decoded))
+
+    resp = get("/large", "identity")
+    assert.Equal("", resp.Header().Get("Content-Encoding"))
+    assert.Equal(body, resp.Body.String())
+
+    // unless already compressed or too small to be worth it
+    resp = get("/archive", "gzip")
+    assert.Equal("", resp.Header().Get("Content-Encoding"))
+    assert.Equal(body, resp.Body.String())
+    resp = get("/small", "gzip")
+    assert.Equal("", resp.Header().Get("Content-Encoding"))
+    assert.Equal("{}", resp.Body.String())
+
+    // cached routes are sent their stored variant, compressed only once
+    for _, cacheStatus := range []string{"MISS", "HIT"} {
+        resp = get("/cached/large", "br")
+        assert.Equal(cacheStatus, resp.Header().Get("X-Cache"))
+        assert.Equal("br", resp.Header().Get("Content-Encoding"))
+        assert.Equal("Accept-Encoding", resp.Header().Get("Vary"))
+        decoded, _ = ioutil.ReadAll(brotli.NewReader(resp.Body))
+        assert.Equal(body, string(decoded))
+    }
+}
+
+func TestGinCacheConditional(t *testing.T) {
+    assert := assert.New(t)
+
+    gin.SetMode(gin.ReleaseMode)
+    r := gin.New()
+    r.Use(GinCache)
+    r.GET("/conditional", CacheControl(CatalogCacheControl),
+          func(c *gin.Context) {
+        c.String(200, "body")
+    })
+
+    get := func(name string, value string) *httptest.ResponseRecorder {
+        req, _ := http.NewRequest("GET", "/conditional", nil)
+        if name != "" {
+            req.Header.Set(name, value)
+        }
+        resp := httptest.NewRecorder()
+        r.ServeHTTP(resp, req)
+        return resp
+    }
+
+    // a conditional first request still caches the full response
+    resp := get("If-Modified-Since", "Mon, 02 Jan 2006 15:04:05 GMT")
+    assert.Equal(200, resp.Code)
+    assert.Equal("body", resp.Body.String())
+    assert.Equal(CatalogCacheControl, resp.Header().Get("Cache-Control"))
+
+    etag := resp.Header().Get("ETag")
+    lastModified := resp.Header().Get("Last-Modified")
+    assert.NotEmpty(etag)
+    assert.NotEmpty(lastModified)
+
+    // validators are answered by the cache
+    resp = get("If-None-Match", etag)
+    assert.Equal(304, resp.Code)
+    assert.Empty(resp.Body.String())
+
+    resp = get("If-Modified-Since", lastModified)
+    assert.Equal(304, resp.Code)
+
+    // If-None-Match takes precedence
+    req, _ := http.NewRequest("GET", "/conditional", nil)
+    req.Header.Set("If-None-Match", "\"other\"")
+    req.Header.Set("If-Modified-Since", lastModified)
+    resp = httptest.NewRecorder()
+    r.ServeHTTP(resp, req)
+    assert.Equal(200, resp.Code)
+
+    resp = get("", "")
+    assert.Equal(200, resp.Code)
+    assert.Equal("body", resp.Body.String())
+}
+
+func TestGinCacheHead(t *testing.T) {
+    assert := assert.New(t)
+
+    gin.SetMode(gin.ReleaseMode)
+    r := gin.New()
+    r.Use(GinCache)
+    handler := func(c *gin.Context) {
+        c.String(200, "head body")
+    }
+    r.GET("/head", handler)
+    r.HEAD("/head", handler)
+
+    request := func(method string) *httptest.ResponseRecorder {
+        req, _ := http.NewRequest(method, "/head", nil)
+        resp := httptest.NewRecorder()
+        r.ServeHTTP(resp, req)
+        return resp
+    }
+
+    // HEAD isn't cached on its own
+    resp := request("HEAD")
+    assert.Equal(200, resp.Code)
+    assert.Equal("MISS", resp.Header().Get("X-Cache"))
+
+    get := request("GET")
+    assert.Equal("MISS", get.Header().Get("X-Cache"))
+    assert.Equal("head body", get.Body.String())
+
+    // but is answered from the GET with its length and etag
+    resp = request("HEAD")
+    assert.Equal(200, resp.Code)
+    assert.Equal("HIT", resp.Header().Get("X-Cache"))
+    assert.Empty(resp.Body.String())
+    assert.Equal("9", resp.Header().Get("Content-Length"))
+    assert.NotEmpty(resp.Header().Get("ETag"))
+    assert.Equal(get.Header().Get("ETag"), resp.Header().Get("ETag"))
+}
+
+func TestCacheRoutesNeedAdmin(t *testing.T) {
+    assert := assert.New(t)
+    gin.SetMode(gin.ReleaseMode)
+    router := GetRouter()
+    _, mock := useTestStores(t)
+
+    // coming from the server itself is no longer enough, as it would be for
+    // every request behind a proxy
+    req := httptest.NewRequest("GET", "/cache/stats", nil)
+    req.RemoteAddr = "127.0.0.1:1234"
+    resp := httptest.NewRecorder()
+    router.ServeHTTP(resp, req)
+    assert.Equal(401, resp.Code, "response code not as expected")
+    resp = testRequest(router, "POST", "/cache/purge", nil)
+    assert.Equal(401, resp.Code, "response code not as expected")
+
+    cookie := testSession(t, 3)
+    mock.ExpectQuery("SELECT role").WithArgs(3).
+        WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(RoleTeacher))
+    resp = testRequest(router, "GET", "/cache/stats", nil, cookie)
+    assert.Equal(403, resp.Code, "response code not as expected")
+
+    mock.ExpectQuery("SELECT role").WithArgs(3).
+        WillReturnRows(sqlmock.NewRows([]string{"role"}).AddRow(RoleAdmin))
+    resp = testRequest(router, "GET", "/cache/stats", nil, cookie)
+    assert.Equal(200, resp.Code, "response code not as expected")
+    assert.Nil(mock.ExpectationsWereMet())
+}
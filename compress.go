@@ -0,0 +1,220 @@
+package main
+
+import (
+  "bytes"
+  "compress/gzip"
+  "net/http"
+  "strconv"
+  "strings"
+  "github.com/andybalholm/brotli"
+  "github.com/gin-gonic/gin"
+)
+
+/******************************************************************************
+ * Constants
+ *****************************************************************************/
+
+const (
+    EncodingGzip      string = "gzip"
+    EncodingBrotli    string = "br"
+    CompressMinLength int    = 1024
+    BrotliQuality     int    = 9
+    encodedKey        string = "encoded"
+)
+
+/******************************************************************************
+ * Global Variables
+ *****************************************************************************/
+
+// encodings in order of preference when the client accepts them equally
+var supportedEncodings []string = []string{EncodingBrotli, EncodingGzip}
+
+// any supported encoding, for negotiating before compressing
+var anyEncoding map[string][]byte = map[string][]byte{
+    EncodingBrotli: nil,
+    EncodingGzip:   nil,
+}
+
+// content types worth compressing, anything else is already compressed
+var compressibleTypes []string = []string{
+    "text/",
+    "application/json",
+    "application/javascript",
+    "application/x-javascript",
+    "application/xml",
+    "image/svg+xml",
+    "image/x-icon",
+    "font/ttf",
+    "font/otf",
+    "application/x-font-ttf",
+    "application/vnd.ms-fontobject",
+}
+
+/******************************************************************************
+ * Helper functions
+ *****************************************************************************/
+
+// check if a response with the given content type should be compressed
+func isCompressible(contentType string) bool {
+    contentType = strings.ToLower(contentType)
+    for _, prefix := range compressibleTypes {
+        if strings.HasPrefix(contentType, prefix) {
+            return true
+        }
+    }
+
+    return false
+}
+
+// compress data with the named encoding
+func compress(encoding string, data []byte) ([]byte, error) {
+    var buffer bytes.Buffer
+    var err error
+
+    switch encoding {
+    case EncodingGzip:
+        writer, _ := gzip.NewWriterLevel(&buffer, gzip.BestCompression)
+        if _, err = writer.Write(data); err == nil {
+            err = writer.Close()
+        }
+    case EncodingBrotli:
+        writer := brotli.NewWriterLevel(&buffer, BrotliQuality)
+        if _, err = writer.Write(data); err == nil {
+            err = writer.Close()
+        }
+    }
+
+    return buffer.Bytes(), err
+}
+
+// build the compressed variants of a response, only keeping those which are
+// actually smaller than the original
+func compressVariants(response *responseData) map[string][]byte {
+    variants := make(map[string][]byte)
+    if len(response.data) < CompressMinLength ||
+       response.header.Get("Content-Encoding") != "" ||
+       !isCompressible(response.header.Get("Content-Type")) {
+        return variants
+    }
+
+    for _, encoding := range supportedEncodings {
+        data, err := compress(encoding, response.data)
+        if err == nil && len(data) < len(response.data) {
+            variants[encoding] = data
+        }
+    }
+
+    return variants
+}
+
+// pick the preferred encoding from an Accept-Encoding header out of those
+// available, returns an empty string for identity
+func negotiateEncoding(header string, available map[string][]byte) string {
+    qualities := make(map[string]float64)
+    wildcard := -1.0
+    for _, part := range strings.Split(header, ",") {
+        // split coding and optional quality value
+        fields := strings.Split(part, ";")
+        coding := strings.ToLower(strings.TrimSpace(fields[0]))
+        quality := 1.0
+        for _, param := range fields[1:] {
+            param = strings.TrimSpace(param)
+            if strings.HasPrefix(param, "q=") {
+                if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+                    quality = q
+                }
+            }
+        }
+
+        if coding == "*" {
+            wildcard = quality
+        } else {
+            qualities[coding] = quality
+        }
+    }
+
+    // highest quality wins, ties go to the earlier supported encoding
+    best := ""
+    bestQuality := 0.0
+    for _, encoding := range supportedEncodings {
+        if _, ok := available[encoding]; !ok {
+            continue
+        }
+
+        quality, listed := qualities[encoding]
+        if !listed {
+            quality = wildcard
+        }
+
+        if quality > bestQuality {
+            best = encoding
+            bestQuality = quality
+        }
+    }
+
+    return best
+}
+
+// entity tags differ between encodings of the same response
+func variantETag(etag string, encoding string) string {
+    if etag == "" || encoding == "" || !strings.HasSuffix(etag, "\"") {
+        return etag
+    }
+
+    return strings.TrimSuffix(etag, "\"") + "-" + encoding + "\""
+}
+
+// strip any encoding suffix added by variantETag
+func baseETag(etag string) string {
+    for _, encoding := range supportedEncodings {
+        suffix := "-" + encoding + "\""
+        if strings.HasSuffix(etag, suffix) {
+            return strings.TrimSuffix(etag, suffix) + "\""
+        }
+    }
+
+    return etag
+}
+
+/******************************************************************************
+ * Middleware
+ *****************************************************************************/
+
+// compress responses in the encoding the client prefers, those served by the
+// cache are left as they are as it already picked one of its stored variants
+func Compress(c *gin.Context) {
+    original := c.Writer
+    buffered := newCacheWriter(c.Writer)
+    c.Writer = buffered
+    defer func() {
+        c.Writer = original
+    }()
+
+    c.Next()
+    c.Writer = original
+
+    // only full responses with a body, ranges would no longer line up
+    header := original.Header()
+    data := buffered.blob
+    if !c.GetBool(encodedKey) && c.Request.Method != "HEAD" &&
+       buffered.status == http.StatusOK && len(data) >= CompressMinLength &&
+       header.Get("Content-Encoding") == "" &&
+       isCompressible(header.Get("Content-Type")) {
+        header.Add("Vary", "Accept-Encoding")
+        encoding := negotiateEncoding(c.GetHeader("Accept-Encoding"),
+                                      anyEncoding)
+        if encoding != "" {
+            compressed, err := compress(encoding, data)
+            if err == nil && len(compressed) < len(data) {
+                data = compressed
+                header.Del("Accept-Ranges")
+                header.Set("Content-Encoding", encoding)
+                header.Set("Content-Length", strconv.Itoa(len(data)))
+                header.Set("ETag", variantETag(header.Get("ETag"), encoding))
+            }
+        }
+    }
+
+    original.WriteHeader(buffered.status)
+    original.Write(data)
+}
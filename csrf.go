@@ -0,0 +1,100 @@
+package main
+
+import (
+  "crypto/subtle"
+  "encoding/base64"
+  "net/http"
+  "net/url"
+  "github.com/gin-gonic/gin"
+)
+
+/******************************************************************************
+ * Constants
+ *****************************************************************************/
+
+const (
+    CSRFCookieName string = "FIRMAMENT_CSRF"
+    CSRFHeaderName string = "X-CSRF-Token"
+    CSRFTokenBytes int    = 32
+)
+
+/******************************************************************************
+ * Helper functions
+ *****************************************************************************/
+
+// returns a configured cookie object for the csrf token, readable by our
+// scripts so they can echo it back in a header
+func createCSRFCookie(token string) *http.Cookie {
+    cookie := http.Cookie{}
+    cookie.Name = CSRFCookieName
+    cookie.Value = token
+    cookie.Path = "/"
+    cookie.Secure = true
+    cookie.SameSite = http.SameSiteStrictMode
+    return &cookie
+}
+
+// check a request came from one of our pages, if the browser says where
+func isSameOrigin(c *gin.Context) bool {
+    origin := c.GetHeader("Origin")
+    if origin == "" {
+        origin = c.GetHeader("Referer")
+    }
+    if origin == "" {
+        return true
+    }
+
+    parsed, err := url.Parse(origin)
+    if err != nil || parsed.Host == "" {
+        return false
+    }
+
+    site, err := url.Parse(siteURL)
+    if err == nil && parsed.Host == site.Host {
+        return true
+    }
+
+    return parsed.Host == c.Request.Host
+}
+
+/******************************************************************************
+ * Middleware
+ *****************************************************************************/
+
+// reject state changing requests made with cookies from other sites, they
+// must come from our origin and repeat the token from the csrf cookie
+func CSRFProtect(c *gin.Context) {
+    // hand out a token to anyone without one
+    cookie, err := c.Request.Cookie(CSRFCookieName)
+    if err != nil || cookie.Value == "" {
+        bytes, err := generateRandomId(CSRFTokenBytes)
+        if err == nil {
+            token := base64.URLEncoding.EncodeToString(bytes)
+            http.SetCookie(c.Writer, createCSRFCookie(token))
+        }
+        cookie = nil
+    }
+
+    switch c.Request.Method {
+    case "GET", "HEAD", "OPTIONS":
+        return
+    }
+
+    // api tokens aren't sent automatically by browsers, so can't be forged
+    if getBearerToken(c) != "" {
+        return
+    }
+
+    if !isSameOrigin(c) {
+        c.AbortWithStatusJSON(403, gin.H{"error": "cross origin request refused"})
+        return
+    }
+
+    header := c.GetHeader(CSRFHeaderName)
+    if cookie == nil || header == "" ||
+       subtle.ConstantTimeCompare([]byte(header), []byte(cookie.Value)) != 1 {
+        c.AbortWithStatusJSON(403, gin.H{"error": "invalid csrf token, " +
+                                                  "please reload the page"})
+        return
+    }
+}
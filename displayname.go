@@ -0,0 +1,167 @@
+package main
+
+import (
+  "bufio"
+  "bytes"
+  "database/sql"
+  "io/fs"
+  "log"
+  "regexp"
+  "strconv"
+  "strings"
+  "github.com/gin-gonic/gin"
+  "github.com/lib/pq"
+)
+
+/******************************************************************************
+ * Constants
+ *****************************************************************************/
+
+const (
+    DisplayNameRegex      string = "^[A-Za-z0-9_\\-]{3,20}$"
+    DefaultDisplayName    string = "Stargazer"
+    DisplayNameConstraint string = "user_display_name_key"
+    blockedNamesPath      string = "data/blocked-names.txt"
+)
+
+/******************************************************************************
+ * Global Variables
+ *****************************************************************************/
+
+var (
+    // words display names may not contain
+    blockedNames []string
+
+    // undo the usual ways of disguising a word
+    lookAlikes *strings.Replacer = strings.NewReplacer(
+        "0", "o", "1", "i", "3", "e", "4", "a", "5", "s", "7", "t",
+        "@", "a", "$", "s", "_", "", "-", "")
+
+    // default names are taken by the user with that id
+    defaultNameRegex *regexp.Regexp =
+        regexp.MustCompile("(?i)^" + DefaultDisplayName + "[0-9]+$")
+)
+
+/******************************************************************************
+ * Helper functions
+ *****************************************************************************/
+
+// read the words display names may not contain from the site files
+func loadBlockedNames() {
+    raw, err := fs.ReadFile(siteFiles, blockedNamesPath)
+    if err != nil {
+        log.Fatal("Failed to read blocked names file.")
+    }
+
+    names := []string{}
+    scanner := bufio.NewScanner(bytes.NewReader(raw))
+    for scanner.Scan() {
+        line := strings.TrimSpace(scanner.Text())
+        if line != "" && !strings.HasPrefix(line, "#") {
+            names = append(names, lookAlikes.Replace(strings.ToLower(line)))
+        }
+    }
+
+    blockedNames = names
+}
+
+// display name of users who haven't chosen one
+func defaultDisplayName(userId int) string {
+    return DefaultDisplayName + strconv.Itoa(userId)
+}
+
+// returns why a display name can't be used, empty if it can
+func checkDisplayName(name string) string {
+    if !regexp.MustCompile(DisplayNameRegex).MatchString(name) {
+        return "display name must be 3 to 20 letters, digits, - or _"
+    }
+
+    if defaultNameRegex.MatchString(name) {
+        return "display name is already taken"
+    }
+
+    normalised := lookAlikes.Replace(strings.ToLower(name))
+    for _, blocked := range blockedNames {
+        if strings.Contains(normalised, blocked) {
+            return "display name is not allowed"
+        }
+    }
+
+    return ""
+}
+
+// check if an error is a clash with another user's display name
+func isDisplayNameTaken(err error) bool {
+    pqErr, ok := err.(*pq.Error)
+    return ok && pqErr.Code == pqUniqueViolation &&
+           pqErr.Constraint == DisplayNameConstraint
+}
+
+// name shown to other users, real names only if the user allows it
+func publicName(userId int, displayName sql.NullString,
+                firstName string, lastName string, showRealName bool) string {
+    if showRealName {
+        return firstName + " " + lastName
+    } else if displayName.Valid {
+        return displayName.String
+    }
+
+    return defaultDisplayName(userId)
+}
+
+// public names of several users by id, users which don't exist are left out
+func getPublicNames(userIds []int) (map[int]string, error) {
+    rows, err := stores.sqlPool.Query(
+        "SELECT user_id, display_name, first_name, last_name, show_real_name " +
+        "FROM webapp.user WHERE user_id = ANY($1)", pq.Array(userIds))
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    names := make(map[int]string)
+    for rows.Next() {
+        var userId int
+        var displayName sql.NullString
+        var firstName, lastName string
+        var showRealName bool
+        err = rows.Scan(&userId, &displayName, &firstName, &lastName,
+                        &showRealName)
+        if err != nil {
+            return nil, err
+        }
+
+        names[userId] = publicName(userId, displayName, firstName, lastName,
+                                   showRealName)
+    }
+
+    return names, rows.Err()
+}
+
+/******************************************************************************
+ * Handlers
+ *****************************************************************************/
+
+// moderate a display name by putting the user back to the default
+func handleResetDisplayName(c *gin.Context) {
+    userId, err := strconv.Atoi(c.Param("user"))
+    if err != nil {
+        c.JSON(404, gin.H{"error": "user not found"})
+        return
+    }
+
+    r, err := stores.sqlPool.Exec(
+        "UPDATE webapp.user SET display_name=NULL WHERE user_id=$1", userId)
+    if err != nil {
+        c.JSON(500, gin.H{"error": "unexpected error occurred"})
+        return
+    }
+
+    if rows, _ := r.RowsAffected(); rows != 1 {
+        c.JSON(404, gin.H{"error": "user not found"})
+        return
+    }
+
+    c.JSON(200, gin.H{"message": "display name has been reset",
+                      "displayName": defaultDisplayName(userId)})
+}
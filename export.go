@@ -0,0 +1,286 @@
+package main
+
+import (
+  "archive/zip"
+  "bytes"
+  "database/sql"
+  "encoding/csv"
+  "sort"
+  "strconv"
+  "strings"
+  "time"
+  "github.com/gin-gonic/gin"
+  "github.com/garyburd/redigo/redis"
+)
+
+/******************************************************************************
+ * Type Declarations
+ *****************************************************************************/
+
+type ExportedUser struct {
+    UserId           int        `json:"userId"`
+    FirstName        string     `json:"firstName"`
+    LastName         string     `json:"lastName"`
+    Email            string     `json:"email"`
+    EmailVerified    bool       `json:"emailVerified"`
+    DisplayName      string     `json:"displayName"`
+    ShowRealName     bool       `json:"showRealName"`
+    Role             string     `json:"role"`
+    RegistrationTime time.Time  `json:"registrationTime"`
+    LastLogin        *time.Time `json:"lastLogin"`
+}
+
+type ExportedScore struct {
+    Score uint64 `json:"score"`
+}
+
+type ExportedLobby struct {
+    Id     string `json:"id"`
+    Host   bool   `json:"host"`
+    Status string `json:"status"`
+    Score  int    `json:"score"`
+}
+
+type ExportedIdentity struct {
+    Provider string `json:"provider"`
+    Subject  string `json:"subject"`
+}
+
+// everything stored about a user, except secrets such as password hashes
+type UserExport struct {
+    Exported    time.Time              `json:"exported"`
+    User        ExportedUser           `json:"user"`
+    Progress    []FamilyProgress       `json:"progress"`
+    Learned     []LearnedConstellation `json:"learned"`
+    History     []ProgressEvent        `json:"progressHistory"`
+    Leaderboard []ExportedScore        `json:"leaderboard"`
+    Lobbies     []ExportedLobby        `json:"lobbies"`
+    Sessions    []Session              `json:"sessions"`
+    ApiTokens   []ApiToken             `json:"apiTokens"`
+    Identities  []ExportedIdentity     `json:"identities"`
+}
+
+/******************************************************************************
+ * Helper functions
+ *****************************************************************************/
+
+// gather everything stored about a user
+func exportUserData(userId int, currentHash string) (*UserExport, error) {
+    export := UserExport{Exported: time.Now().UTC()}
+
+    user := &export.User
+    var displayName sql.NullString
+    err := stores.sqlPool.QueryRow(
+        "SELECT user_id, first_name, last_name, email, email_verified, " +
+        "display_name, show_real_name, role, registration_time, " +
+        "last_login " +
+        "FROM webapp.user WHERE user_id=$1",
+        userId).Scan(&user.UserId, &user.FirstName, &user.LastName,
+                     &user.Email, &user.EmailVerified, &displayName,
+                     &user.ShowRealName, &user.Role, &user.RegistrationTime,
+                     &user.LastLogin)
+    if err != nil {
+        return nil, err
+    }
+
+    user.DisplayName = displayName.String
+    if !displayName.Valid {
+        user.DisplayName = defaultDisplayName(userId)
+    }
+
+    if export.Progress, err = getTotalUserProgress(userId); err != nil {
+        return nil, err
+    }
+    if export.Learned, err = listLearnedConstellations(userId); err != nil {
+        return nil, err
+    }
+    if export.History, err = listProgressHistory(userId); err != nil {
+        return nil, err
+    }
+
+    export.Leaderboard = []ExportedScore{}
+    con := stores.redisPool.Get()
+    score, err := redis.Uint64(con.Do("ZSCORE", "leaderboard", userId))
+    con.Close()
+    if err == nil {
+        export.Leaderboard = append(export.Leaderboard, ExportedScore{score})
+    } else if err != redis.ErrNil {
+        return nil, err
+    }
+
+    export.Lobbies = []ExportedLobby{}
+    for lobbyId, item := range stores.lobbyStore.Items() {
+        lobby := item.Object.(*Lobby)
+        if player := lobby.player(userId); player != nil {
+            export.Lobbies = append(export.Lobbies, ExportedLobby{
+                lobbyId, lobby.Host == userId, lobby.Data.Status,
+                player.Score})
+        }
+    }
+    sort.Slice(export.Lobbies, func(i, j int) bool {
+        return export.Lobbies[i].Id < export.Lobbies[j].Id
+    })
+
+    if export.Sessions, err = listUserSessions(userId, currentHash); err != nil {
+        return nil, err
+    }
+
+    // api tokens without their hashes
+    if export.ApiTokens, err = listApiTokens(userId); err != nil {
+        return nil, err
+    }
+
+    rows, err := stores.sqlPool.Query(
+        "SELECT provider, subject FROM webapp.user_identity " +
+        "WHERE user_id=$1 ORDER BY provider", userId)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+    export.Identities = []ExportedIdentity{}
+    for rows.Next() {
+        var identity ExportedIdentity
+        if err = rows.Scan(&identity.Provider, &identity.Subject); err != nil {
+            return nil, err
+        }
+        export.Identities = append(export.Identities, identity)
+    }
+
+    return &export, rows.Err()
+}
+
+// format an optional time for csv
+func csvTime(t *time.Time) string {
+    if t == nil {
+        return ""
+    }
+
+    return t.UTC().Format(time.RFC3339)
+}
+
+// write the export as one csv file per table inside a zip archive
+func zipUserExport(export *UserExport) ([]byte, error) {
+    user := export.User
+    tables := []struct {
+        name string
+        rows [][]string
+    }{
+        {"user.csv", [][]string{
+            {"user_id", "first_name", "last_name", "email", "email_verified",
+             "display_name", "show_real_name", "role", "registration_time",
+             "last_login"},
+            {strconv.Itoa(user.UserId), user.FirstName, user.LastName,
+             user.Email, strconv.FormatBool(user.EmailVerified),
+             user.DisplayName, strconv.FormatBool(user.ShowRealName),
+             user.Role, csvTime(&user.RegistrationTime),
+             csvTime(user.LastLogin)},
+        }},
+        {"progress.csv", [][]string{{"family", "completed", "total"}}},
+        {"learned.csv", [][]string{{"constellation", "family", "learned"}}},
+        {"progress_history.csv", [][]string{{"constellation", "event",
+                                             "recorded"}}},
+        {"leaderboard.csv", [][]string{{"score"}}},
+        {"lobbies.csv", [][]string{{"lobby_id", "host", "status", "score"}}},
+        {"sessions.csv", [][]string{{"session_id", "current", "created",
+                                     "last_seen", "user_agent", "ip"}}},
+        {"api_tokens.csv", [][]string{{"token_id", "name", "scopes",
+                                       "created", "last_used"}}},
+        {"identities.csv", [][]string{{"provider", "subject"}}},
+    }
+
+    for _, p := range export.Progress {
+        tables[1].rows = append(tables[1].rows, []string{p.Name,
+            strconv.FormatUint(p.Completed, 10), strconv.FormatUint(p.Total, 10)})
+    }
+    for _, l := range export.Learned {
+        tables[2].rows = append(tables[2].rows, []string{l.Name, l.Family,
+            csvTime(&l.Learned)})
+    }
+    for _, e := range export.History {
+        tables[3].rows = append(tables[3].rows, []string{e.Constellation,
+            e.Event, csvTime(&e.Recorded)})
+    }
+    for _, s := range export.Leaderboard {
+        tables[4].rows = append(tables[4].rows,
+                                []string{strconv.FormatUint(s.Score, 10)})
+    }
+    for _, l := range export.Lobbies {
+        tables[5].rows = append(tables[5].rows, []string{l.Id,
+            strconv.FormatBool(l.Host), l.Status, strconv.Itoa(l.Score)})
+    }
+    for _, s := range export.Sessions {
+        created, seen := time.Unix(s.Created, 0), time.Unix(s.LastSeen, 0)
+        tables[6].rows = append(tables[6].rows, []string{s.Id,
+            strconv.FormatBool(s.Current), csvTime(&created), csvTime(&seen),
+            s.UserAgent, s.IP})
+    }
+    for _, t := range export.ApiTokens {
+        tables[7].rows = append(tables[7].rows, []string{strconv.Itoa(t.Id),
+            t.Name, strings.Join(t.Scopes, " "), csvTime(&t.Created),
+            csvTime(t.LastUsed)})
+    }
+    for _, i := range export.Identities {
+        tables[8].rows = append(tables[8].rows, []string{i.Provider, i.Subject})
+    }
+
+    var buffer bytes.Buffer
+    archive := zip.NewWriter(&buffer)
+    for _, table := range tables {
+        file, err := archive.Create(table.name)
+        if err != nil {
+            return nil, err
+        }
+
+        writer := csv.NewWriter(file)
+        writer.WriteAll(table.rows)
+        if err = writer.Error(); err != nil {
+            return nil, err
+        }
+    }
+
+    if err := archive.Close(); err != nil {
+        return nil, err
+    }
+
+    return buffer.Bytes(), nil
+}
+
+/******************************************************************************
+ * Handlers
+ *****************************************************************************/
+
+func handleExport(c *gin.Context) {
+    // get userid of logged in user, abort if 0
+    userId, token := getLoggedInUser(c)
+    if userId <= 0 {
+        c.JSON(401, gin.H{"error": "not logged in"})
+        return
+    }
+
+    export, err := exportUserData(userId, sessionTokenHash(token))
+    if err != nil {
+        c.JSON(500, gin.H{"error": "unexpected error occurred"})
+        return
+    }
+
+    // personal data must never be kept by caches along the way
+    c.Header("Cache-Control", "no-store")
+    filename := "firmament-export-" + export.Exported.Format("2006-01-02")
+
+    if c.Query("format") == "zip" {
+        archive, err := zipUserExport(export)
+        if err != nil {
+            c.JSON(500, gin.H{"error": "unexpected error occurred"})
+            return
+        }
+
+        c.Header("Content-Disposition",
+                 "attachment; filename=\"" + filename + ".zip\"")
+        c.Data(200, "application/zip", archive)
+        return
+    }
+
+    c.Header("Content-Disposition",
+             "attachment; filename=\"" + filename + ".json\"")
+    c.IndentedJSON(200, export)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+  "embed"
+  "io/fs"
+  "log"
+  "net/http"
+  "os"
+  "sync"
+)
+
+/******************************************************************************
+ * Global Variables
+ *****************************************************************************/
+
+// data and assets built into the binary so it runs from any directory
+//go:embed index.html assets data
+var embeddedFiles embed.FS
+
+var (
+    // files the site is served from, embedded unless overridden
+    siteFiles fs.FS = embeddedFiles
+    siteOnce  sync.Once
+)
+
+/******************************************************************************
+ * Helper functions
+ *****************************************************************************/
+
+// load catalog, assets and blocked names, from dir instead of the embedded
+// files if given, only the first call has any effect
+func loadSite(dir string) {
+    siteOnce.Do(func() {
+        if dir != "" {
+            siteFiles = os.DirFS(dir)
+        }
+
+        loadCatalog()
+        loadAssets()
+        loadBlockedNames()
+    })
+}
+
+// returns the assets directory for serving over http
+func assetFileSystem() http.FileSystem {
+    assets, err := fs.Sub(siteFiles, AssetsDir)
+    if err != nil {
+      log.Fatal("Failed to open assets directory.")
+    }
+
+    return http.FS(assets)
+}
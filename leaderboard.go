@@ -1,6 +1,7 @@
 package main
 
 import (
+  "fmt"
   "strconv"
   "github.com/gin-gonic/gin"
   "github.com/garyburd/redigo/redis"
@@ -10,44 +11,59 @@ import (
  * Type Declarations
  *****************************************************************************/
 
-type LeaderboardEntries []struct {
+type LeaderboardEntry struct {
     Name  string `json:"name"`
     Score uint64 `json:"score"`
 }
 
+type LeaderboardEntries []LeaderboardEntry
+
 /******************************************************************************
  * Helper functions
  *****************************************************************************/
 
 // adds entry to the leaderboard, will remove leaderboard entires out of top 10
 func insertLeaderboardEntry(userId int, score uint64) error {
-    var firstName string
-    var lastName string
-    err := stores.sqlPool.QueryRow(
-        "SELECT first_name, last_name FROM webapp.user " +
-        "WHERE user_id=$1", userId).Scan(&firstName, &lastName)
+    // entries are keyed by user id, names are looked up when shown
+    con := stores.redisPool.Get()
+    defer con.Close()
 
-    // check if user actually exists in database
+    _, err := con.Do("ZADD", "leaderboard", score, userId)
     if err != nil {
         return err
     }
 
-    // we have their name and score, add to leaderboard
+    // delete entries from leaderboard that aren't in the top 10
+    con.Do("ZREMRANGEBYRANK", "leaderboard", 0, -11)
+    return nil
+}
+
+// remove entries kept by name from before the leaderboard was keyed by user
+// id, they can't be shown and would hold places in the top 10 forever
+func removeLegacyLeaderboardEntries() error {
     con := stores.redisPool.Get()
     defer con.Close()
-   
-    name := firstName + " " + lastName
-    _, err = con.Do("ZADD", "leaderboard", score, name)
+
+    members, err := redis.Strings(con.Do("ZRANGE", "leaderboard", 0, -1))
     if err != nil {
         return err
     }
 
-    // delete entries from leaderboard that aren't in the top 10
-    con.Do("ZREMRANGEBYRANK", "leaderboard", 0, -11)
-    return nil
-}
+    removed := 0
+    for _, member := range members {
+        if _, err := strconv.Atoi(member); err == nil {
+            continue
+        }
 
+        if _, err = con.Do("ZREM", "leaderboard", member); err != nil {
+            return err
+        }
+        removed++
+    }
 
+    fmt.Printf("Removed %d legacy leaderboard entries\n", removed)
+    return nil
+}
 
 /******************************************************************************
  * Handlers
@@ -66,12 +82,38 @@ func handleGetLeaderboard(c *gin.Context) {
         return
     }
 
-    var entries = LeaderboardEntries{}
-    if err := redis.ScanSlice(values, &entries); err != nil {
+    var scores []struct {
+        Member string
+        Score  uint64
+    }
+    if err := redis.ScanSlice(values, &scores); err != nil {
         c.JSON(400, gin.H{"error": "leaderboard went away"})
         return
     }
 
+    // entries from before they were keyed by user id can't be shown, they
+    // are removed by "firmament migrate leaderboard"
+    userIds := []int{}
+    for _, entry := range scores {
+        if userId, err := strconv.Atoi(entry.Member); err == nil {
+            userIds = append(userIds, userId)
+        }
+    }
+
+    names, err := getPublicNames(userIds)
+    if err != nil {
+        c.JSON(500, gin.H{"error": "unexpected error occurred"})
+        return
+    }
+
+    var entries = LeaderboardEntries{}
+    for _, entry := range scores {
+        userId, _ := strconv.Atoi(entry.Member)
+        if name, ok := names[userId]; ok {
+            entries = append(entries, LeaderboardEntry{name, entry.Score})
+        }
+    }
+
     c.JSON(200, entries)
 }
 
@@ -90,7 +132,7 @@ func handleAddToLeaderboard(c *gin.Context) {
         return
     }
 
-    // get user name and add to leaderboard
+    // add to leaderboard
     err = insertLeaderboardEntry(userId, score)
     if err != nil {
       c.JSON(500, gin.H{"error": "failed to add entry to leaderboard"})
@@ -108,5 +150,6 @@ func handleAddToLeaderboard(c *gin.Context) {
 // setup /leaderboard routes
 func leaderboardRoutes(user *gin.RouterGroup) {
     user.GET("", handleGetLeaderboard)
-    user.POST("", handleAddToLeaderboard)
+    user.POST("", TokenScope(ScopeLeaderboard), RequireVerified,
+                  handleAddToLeaderboard)
 }
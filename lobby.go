@@ -5,6 +5,7 @@ import (
   "github.com/gin-gonic/gin"
   "github.com/patrickmn/go-cache"
   "math"
+  "time"
 )
 
 /******************************************************************************
@@ -27,9 +28,16 @@ type UserAnswers []struct {
     Dec  float64 `json:"dec"`
 }
 
+// a player in a lobby, known by user id and shown by public name
+type LobbyPlayer struct {
+    UserId int    `json:"-"`
+    Name   string `json:"name"`
+    Score  int    `json:"score"`
+}
+
 type LobbyData struct {
-    Status string         `json:"status"`
-    Scores map[string]int `json:"scores"`
+    Status  string        `json:"status"`
+    Players []LobbyPlayer `json:"players"`
 }
 
 type Lobby struct {
@@ -49,19 +57,24 @@ func getLoggedInUsername(c *gin.Context) (string, int) {
         return "", 0
     }
 
-    // get username from database
-    var firstName string
-    var lastName  string
-    err := stores.sqlPool.QueryRow(
-        "SELECT first_name, last_name FROM webapp.user " +
-        "WHERE user_id=$1", userId).Scan(&firstName, &lastName)
-
-    if err != nil {
+    // get the name other players see
+    names, err := getPublicNames([]int{userId})
+    if err != nil || names[userId] == "" {
         return "", 0
     }
 
-    // construct full name and return
-    return firstName + " " + lastName, userId
+    return names[userId], userId
+}
+
+// returns the player with the given user id, nil if not in the lobby
+func (lobby *Lobby) player(userId int) *LobbyPlayer {
+    for index := range lobby.Data.Players {
+        if lobby.Data.Players[index].UserId == userId {
+            return &lobby.Data.Players[index]
+        }
+    }
+
+    return nil
 }
 
 func getUserScore(questions []Constellation, answers UserAnswers) int {
@@ -90,9 +103,9 @@ func getUserScore(questions []Constellation, answers UserAnswers) int {
     return score
 }
 
-func lobbyHasEnded(scores map[string]int) bool {
-    for _, value := range scores {
-        if value < 0 {
+func lobbyHasEnded(players []LobbyPlayer) bool {
+    for _, player := range players {
+        if player.Score < 0 {
             return false
         }
     }
@@ -136,12 +149,11 @@ func handleLobbyCreate(c *gin.Context) {
     lobbyId := base64.URLEncoding.EncodeToString(bytes)
 
     // setup lobby data object
-    users := make(map[string]int)
-    users[username] = -1
-    data := LobbyData{"ready", users}
+    players := []LobbyPlayer{{userId, username, -1}}
+    data := LobbyData{"ready", players}
 
     // get constellations and setup lobby
-    questions := getRandomConstellations(NumberOfQuestions)
+    questions := defaultCulture.getRandomConstellations(NumberOfQuestions)
     lobby := Lobby{data, userId, questions}
 
     // store lobby and return
@@ -168,7 +180,7 @@ func handleLobbyJoin(c *gin.Context) {
     lobby := ptr.(*Lobby)
 
     // check that lobby is not full
-    if len(lobby.Data.Scores) >= LobbyMaxPlayers {
+    if len(lobby.Data.Players) >= LobbyMaxPlayers {
         c.JSON(401, gin.H{"error": "lobby is full"})
         return
     }
@@ -179,15 +191,18 @@ func handleLobbyJoin(c *gin.Context) {
         return
     }
 
-    // add user to lobby
-    lobby.Data.Scores[username] = -1
+    // add user to lobby, once
+    if lobby.player(userId) == nil {
+        lobby.Data.Players = append(lobby.Data.Players,
+                                    LobbyPlayer{userId, username, -1})
+    }
     c.JSON(200, gin.H{"message": "added to lobby",
                       "questions": lobby.Constellations})
 }
 
 func handleLobbyUserFinished(c *gin.Context) {
-    // check that user is logged in and get username
-    username, userId := getLoggedInUsername(c)
+    // check that user is logged in
+    userId, _ := getLoggedInUser(c)
     if userId <= 0 {
         c.JSON(400, gin.H{"error": "user not logged in"})
         return
@@ -216,17 +231,17 @@ func handleLobbyUserFinished(c *gin.Context) {
     }
 
     // check that user is part of lobby
-    if _, ok := lobby.Data.Scores[username]; !ok {
+    player := lobby.player(userId)
+    if player == nil {
         c.JSON(400, gin.H{"error": "you are not a member of this lobby"})
         return
     }
 
     // calculate and set user score
-    score := getUserScore(lobby.Constellations, answers)
-    lobby.Data.Scores[username] = score
+    player.Score = getUserScore(lobby.Constellations, answers)
 
     // check if status should be set to finished
-    if lobbyHasEnded(lobby.Data.Scores) {
+    if lobbyHasEnded(lobby.Data.Players) {
         lobby.Data.Status = "ended"
     }
 
@@ -271,10 +286,16 @@ func handleLobbyStart(c *gin.Context) {
 
 // setup /lobby routes
 func lobbyRoutes(user *gin.RouterGroup) {
+    user.Use(TokenScope(ScopeLobby))
     user.GET("/status/:lobby", handleLobbyStatus)
 
-    user.POST("/join/:lobby", handleLobbyJoin)
-    user.POST("/start/:lobby", handleLobbyStart)
-    user.POST("/create", handleLobbyCreate)
-    user.POST("/finish/:lobby", handleLobbyUserFinished)
+    // only verified users can take part
+    user.POST("/join/:lobby", RequireVerified, handleLobbyJoin)
+    user.POST("/start/:lobby", RequireVerified, handleLobbyStart)
+    user.POST("/create", RequireVerified,
+              RateLimit("lobby-create-ip", LobbyIPLimit, time.Minute,
+                        byClientIP),
+              RateLimit("lobby-create", LobbyAccountLimit, time.Minute, byUser),
+              handleLobbyCreate)
+    user.POST("/finish/:lobby", RequireVerified, handleLobbyUserFinished)
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+  "fmt"
+  "log"
+  "net"
+  "net/mail"
+  "net/smtp"
+  "os"
+  "strings"
+  "sync"
+  "time"
+)
+
+/******************************************************************************
+ * Type Declarations
+ *****************************************************************************/
+
+// sends plain text email to a single recipient
+type Mailer interface {
+    Send(to string, subject string, body string) error
+}
+
+// delivers mail through an smtp relay, authenticating if a user is given
+type SMTPMailer struct {
+    Addr     string
+    From     string
+    User     string
+    Password string
+
+    // bare address of From, the only form servers accept in MAIL FROM
+    sender string
+}
+
+// appends mail to a file instead of sending it, or to the log if no file is
+// given, for development and testing
+type LogMailer struct {
+    Path  string
+    mutex sync.Mutex
+}
+
+/******************************************************************************
+ * Global Variables
+ *****************************************************************************/
+
+var mailer Mailer = &LogMailer{}
+
+// mail still being sent in the background
+var pendingMail sync.WaitGroup
+
+/******************************************************************************
+ * Helper functions
+ *****************************************************************************/
+
+// build an rfc 5322 message, header values must not contain line breaks
+func formatMail(from string, to string, subject string, body string) []byte {
+    clean := strings.NewReplacer("\r", "", "\n", "")
+    return []byte("From: " + clean.Replace(from) + "\r\n" +
+                  "To: " + clean.Replace(to) + "\r\n" +
+                  "Subject: " + clean.Replace(subject) + "\r\n" +
+                  "Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+                  "MIME-Version: 1.0\r\n" +
+                  "Content-Type: text/plain; charset=utf-8\r\n" +
+                  "\r\n" + body + "\r\n")
+}
+
+// send mail after the request has been answered, so how long sending takes
+// can't tell the caller anything, failures are only logged
+func sendMailLater(what string, send func() error) {
+    pendingMail.Add(1)
+    go func() {
+        defer pendingMail.Done()
+        if err := send(); err != nil {
+            log.Println("failed to send " + what + ":", err)
+        }
+    }()
+}
+
+// create a mailer for an smtp relay, from may include a display name
+func NewSMTPMailer(addr string, from string, user string,
+                   password string) (*SMTPMailer, error) {
+    parsed, err := mail.ParseAddress(from)
+    if err != nil {
+        return nil, err
+    }
+
+    return &SMTPMailer{Addr: addr, From: from, User: user, Password: password,
+                       sender: parsed.Address}, nil
+}
+
+func (m *SMTPMailer) Send(to string, subject string, body string) error {
+    var auth smtp.Auth
+    if m.User != "" {
+        host, _, _ := net.SplitHostPort(m.Addr)
+        auth = smtp.PlainAuth("", m.User, m.Password, host)
+    }
+
+    message := formatMail(m.From, to, subject, body)
+    return smtp.SendMail(m.Addr, auth, m.sender, []string{to}, message)
+}
+
+func (m *LogMailer) Send(to string, subject string, body string) error {
+    message := formatMail("firmament", to, subject, body)
+    if m.Path == "" {
+        log.Printf("mail to %s:\n%s", to, message)
+        return nil
+    }
+
+    m.mutex.Lock()
+    defer m.mutex.Unlock()
+
+    file, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+
+    _, err = fmt.Fprintf(file, "%s\n", message)
+    return err
+}
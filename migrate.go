@@ -0,0 +1,405 @@
+package main
+
+import (
+  "context"
+  "database/sql"
+  "embed"
+  "fmt"
+  "io/fs"
+  "log"
+  "os"
+  "path"
+  "regexp"
+  "sort"
+  "strconv"
+  "github.com/lib/pq"
+)
+
+/******************************************************************************
+ * Constants
+ *****************************************************************************/
+
+const (
+    MigrationsDir   string = "migrations"
+    MigrationsTable string = "webapp.schema_migration"
+
+    // held while migrating so two servers can't migrate at once
+    MigrationLockId int64 = 0x6669726d616d656e
+
+    pqUndefinedTable pq.ErrorCode = "42P01"
+)
+
+/******************************************************************************
+ * Type Declarations
+ *****************************************************************************/
+
+type Migration struct {
+    Version int
+    Name    string
+    Up      string
+    Down    string
+}
+
+/******************************************************************************
+ * Global Variables
+ *****************************************************************************/
+
+// schema changes built into the binary, applied in order of version
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+var migrationFileRegex *regexp.Regexp =
+    regexp.MustCompile("^([0-9]+)_([a-z0-9_]+)\\.(up|down)\\.sql$")
+
+/******************************************************************************
+ * Helper functions
+ *****************************************************************************/
+
+// read migrations ordered by version, every version needs an up and a down
+func loadMigrations(files fs.FS) ([]Migration, error) {
+    entries, err := fs.ReadDir(files, MigrationsDir)
+    if err != nil {
+        return nil, err
+    }
+
+    byVersion := make(map[int]*Migration)
+    for _, entry := range entries {
+        match := migrationFileRegex.FindStringSubmatch(entry.Name())
+        if match == nil {
+            return nil, fmt.Errorf("unexpected migration file %s", entry.Name())
+        }
+
+        version, _ := strconv.Atoi(match[1])
+        raw, err := fs.ReadFile(files, path.Join(MigrationsDir, entry.Name()))
+        if err != nil {
+            return nil, err
+        }
+
+        migration := byVersion[version]
+        if migration == nil {
+            migration = &Migration{Version: version, Name: match[2]}
+            byVersion[version] = migration
+        } else if migration.Name != match[2] {
+            return nil, fmt.Errorf("migration %d has two names, %s and %s",
+                                   version, migration.Name, match[2])
+        }
+
+        if match[3] == "up" {
+            migration.Up = string(raw)
+        } else {
+            migration.Down = string(raw)
+        }
+    }
+
+    migrations := []Migration{}
+    for _, migration := range byVersion {
+        if migration.Up == "" || migration.Down == "" {
+            return nil, fmt.Errorf("migration %d is missing its up or down",
+                                   migration.Version)
+        }
+        migrations = append(migrations, *migration)
+    }
+    sort.Slice(migrations, func(i, j int) bool {
+        return migrations[i].Version < migrations[j].Version
+    })
+
+    // versions count up from one so a missing file is noticed
+    for i, migration := range migrations {
+        if migration.Version != i + 1 {
+            return nil, fmt.Errorf("expected migration %d, found %d",
+                                   i + 1, migration.Version)
+        }
+    }
+
+    return migrations, nil
+}
+
+// the migrations built into the binary
+func embeddedMigrations() []Migration {
+    migrations, err := loadMigrations(migrationFiles)
+    if err != nil {
+        log.Fatal("Failed to read migrations: ", err)
+    }
+
+    return migrations
+}
+
+// returns the versions applied to the database, creating the table to record
+// them in if needed
+func appliedMigrations(db *sql.Conn) (map[int]bool, error) {
+    ctx := context.Background()
+    _, err := db.ExecContext(ctx, "CREATE SCHEMA IF NOT EXISTS webapp")
+    if err != nil {
+        return nil, err
+    }
+
+    _, err = db.ExecContext(ctx,
+        "CREATE TABLE IF NOT EXISTS " + MigrationsTable + " (" +
+        "version INTEGER PRIMARY KEY, name TEXT NOT NULL, " +
+        "applied TIMESTAMPTZ NOT NULL DEFAULT NOW())")
+    if err != nil {
+        return nil, err
+    }
+
+    rows, err := db.QueryContext(ctx, "SELECT version FROM " + MigrationsTable)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    applied := make(map[int]bool)
+    for rows.Next() {
+        var version int
+        if err = rows.Scan(&version); err != nil {
+            return nil, err
+        }
+        applied[version] = true
+    }
+
+    return applied, rows.Err()
+}
+
+// run a migration and record it in the same transaction, so a failure
+// leaves the schema as it was
+func applyMigration(con *sql.Conn, migration Migration, up bool) error {
+    ctx := context.Background()
+    tx, err := con.BeginTx(ctx, nil)
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    if up {
+        _, err = tx.ExecContext(ctx, migration.Up)
+        if err == nil {
+            _, err = tx.ExecContext(ctx,
+                "INSERT INTO " + MigrationsTable + "(version, name) " +
+                "VALUES ($1, $2)", migration.Version, migration.Name)
+        }
+    } else {
+        _, err = tx.ExecContext(ctx, migration.Down)
+        if err == nil {
+            _, err = tx.ExecContext(ctx,
+                "DELETE FROM " + MigrationsTable + " WHERE version=$1",
+                migration.Version)
+        }
+    }
+    if err != nil {
+        return err
+    }
+
+    return tx.Commit()
+}
+
+// apply pending migrations up to and including target, or undo applied ones
+// down to but excluding it
+func migrateTo(db *sql.DB, migrations []Migration, target int) error {
+    ctx := context.Background()
+    con, err := db.Conn(ctx)
+    if err != nil {
+        return err
+    }
+    defer con.Close()
+
+    // advisory locks belong to the connection, so keep using the same one
+    _, err = con.ExecContext(ctx, "SELECT pg_advisory_lock($1)", MigrationLockId)
+    if err != nil {
+        return err
+    }
+    defer con.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", MigrationLockId)
+
+    applied, err := appliedMigrations(con)
+    if err != nil {
+        return err
+    }
+
+    for _, migration := range migrations {
+        if migration.Version > target || applied[migration.Version] {
+            continue
+        }
+
+        fmt.Printf("Applying migration %d %s\n", migration.Version,
+                   migration.Name)
+        if err = applyMigration(con, migration, true); err != nil {
+            return fmt.Errorf("migration %d %s failed: %v", migration.Version,
+                              migration.Name, err)
+        }
+    }
+
+    for i := len(migrations) - 1; i >= 0; i-- {
+        migration := migrations[i]
+        if migration.Version <= target || !applied[migration.Version] {
+            continue
+        }
+
+        fmt.Printf("Reverting migration %d %s\n", migration.Version,
+                   migration.Name)
+        if err = applyMigration(con, migration, false); err != nil {
+            return fmt.Errorf("reverting migration %d %s failed: %v",
+                              migration.Version, migration.Name, err)
+        }
+    }
+
+    return nil
+}
+
+// returns the newest version applied, reverting down from there is the only
+// way to leave gaps so any gap means the database was changed by hand
+func schemaVersion(db *sql.DB) (int, error) {
+    var version sql.NullInt64
+    err := db.QueryRow(
+        "SELECT max(version) FROM " + MigrationsTable).Scan(&version)
+    if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == pqUndefinedTable {
+        // no migrations table, nothing has been applied
+        return 0, nil
+    }
+
+    return int(version.Int64), err
+}
+
+// refuse to serve from a schema other than the one this binary was built for
+func checkSchema(db *sql.DB) error {
+    migrations := embeddedMigrations()
+    latest := migrations[len(migrations) - 1].Version
+
+    version, err := schemaVersion(db)
+    if err != nil {
+        return fmt.Errorf("failed to read database schema version: %v", err)
+    }
+
+    if version < latest {
+        return fmt.Errorf("database schema is at version %d but %d is " +
+                          "required, run \"firmament migrate up\"",
+                          version, latest)
+    } else if version > latest {
+        return fmt.Errorf("database schema is at version %d which is newer " +
+                          "than %d, this build is out of date", version, latest)
+    }
+
+    return nil
+}
+
+/******************************************************************************
+ * Command
+ *****************************************************************************/
+
+// firmament migrate up [version] | down [steps] | status | progress |
+// leaderboard
+func migrateCommand(args []string) int {
+    usage := "usage: firmament [flags] migrate up [version] | down [steps] | " +
+             "status | progress | leaderboard"
+    if len(args) < 1 || len(args) > 2 {
+        fmt.Fprintln(os.Stderr, usage)
+        return 2
+    }
+
+    number := -1
+    if len(args) == 2 {
+        n, err := strconv.Atoi(args[1])
+        if err != nil || n < 0 || args[0] == "status" ||
+           args[0] == "progress" || args[0] == "leaderboard" {
+            fmt.Fprintln(os.Stderr, usage)
+            return 2
+        }
+        number = n
+    }
+
+    migrations := embeddedMigrations()
+    latest := migrations[len(migrations) - 1].Version
+
+    version, err := schemaVersion(stores.sqlPool)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "Failed to read database schema version:", err)
+        return 1
+    }
+
+    switch args[0] {
+    case "up":
+        target := latest
+        if number >= 0 {
+            target = number
+        }
+        if target > latest || target < version {
+            fmt.Fprintf(os.Stderr, "Can't migrate up from %d to %d\n",
+                        version, target)
+            return 1
+        }
+        err = migrateTo(stores.sqlPool, migrations, target)
+
+    case "down":
+        // one step unless told otherwise
+        steps := 1
+        if number >= 0 {
+            steps = number
+        }
+        target := version - steps
+        if target < 0 {
+            target = 0
+        }
+        err = migrateTo(stores.sqlPool, migrations, target)
+
+    case "status":
+        con, err := stores.sqlPool.Conn(context.Background())
+        if err != nil {
+            fmt.Fprintln(os.Stderr, "Failed to connect to database:", err)
+            return 1
+        }
+        defer con.Close()
+
+        applied, err := appliedMigrations(con)
+        if err != nil {
+            fmt.Fprintln(os.Stderr, "Failed to read applied migrations:", err)
+            return 1
+        }
+
+        for _, migration := range migrations {
+            state := "pending"
+            if applied[migration.Version] {
+                state = "applied"
+            }
+            fmt.Printf("%04d %-24s %s\n", migration.Version, migration.Name,
+                       state)
+        }
+        return 0
+
+    case "progress":
+        // one-off move of progress out of redis, needs the current schema
+        if err = checkSchema(stores.sqlPool); err != nil {
+            fmt.Fprintln(os.Stderr, err)
+            return 1
+        }
+
+        loadSite(*siteDir)
+        if err = importRedisProgress(); err != nil {
+            fmt.Fprintln(os.Stderr, "Failed to import progress:", err)
+            return 1
+        }
+        return 0
+
+    case "leaderboard":
+        // one-off removal of entries from before they were keyed by user id
+        if err = removeLegacyLeaderboardEntries(); err != nil {
+            fmt.Fprintln(os.Stderr, "Failed to clean up leaderboard:", err)
+            return 1
+        }
+        return 0
+
+    default:
+        fmt.Fprintln(os.Stderr, usage)
+        return 2
+    }
+
+    if err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        return 1
+    }
+
+    version, err = schemaVersion(stores.sqlPool)
+    if err != nil {
+        fmt.Fprintln(os.Stderr, "Failed to read database schema version:", err)
+        return 1
+    }
+
+    fmt.Printf("Database schema is at version %d of %d\n", version, latest)
+    return 0
+}
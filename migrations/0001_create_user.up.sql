@@ -0,0 +1,13 @@
+-- users as originally created by hand, existing databases already have this
+CREATE SCHEMA IF NOT EXISTS webapp;
+
+CREATE TABLE IF NOT EXISTS webapp.user (
+    user_id           SERIAL PRIMARY KEY,
+    first_name        TEXT NOT NULL,
+    last_name         TEXT NOT NULL,
+    email             TEXT NOT NULL,
+    password          BYTEA NOT NULL,
+    registration_time TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_login        TIMESTAMPTZ,
+    CONSTRAINT user_email_key UNIQUE (email)
+);
@@ -0,0 +1,5 @@
+-- accounts from before verification existed are trusted, new ones start out
+-- unverified
+ALTER TABLE webapp.user
+    ADD COLUMN IF NOT EXISTS email_verified BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE webapp.user ALTER COLUMN email_verified SET DEFAULT FALSE;
@@ -0,0 +1,4 @@
+DROP TABLE webapp.user_identity;
+
+-- fails if any user has no password, they have to set one first
+ALTER TABLE webapp.user ALTER COLUMN password SET NOT NULL;
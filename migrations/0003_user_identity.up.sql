@@ -0,0 +1,13 @@
+-- users created through a login provider have no password
+ALTER TABLE webapp.user ALTER COLUMN password DROP NOT NULL;
+
+CREATE TABLE IF NOT EXISTS webapp.user_identity (
+    provider TEXT NOT NULL,
+    subject  TEXT NOT NULL,
+    user_id  INTEGER NOT NULL REFERENCES webapp.user ON DELETE CASCADE,
+    created  TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (provider, subject)
+);
+
+CREATE INDEX IF NOT EXISTS user_identity_user_id_idx
+    ON webapp.user_identity (user_id);
@@ -0,0 +1 @@
+DROP TABLE webapp.api_token;
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS webapp.api_token (
+    token_id   SERIAL PRIMARY KEY,
+    user_id    INTEGER NOT NULL REFERENCES webapp.user ON DELETE CASCADE,
+    name       TEXT NOT NULL,
+    scopes     TEXT NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    created    TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_used  TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS api_token_user_id_idx ON webapp.api_token (user_id);
@@ -0,0 +1 @@
+ALTER TABLE webapp.user DROP COLUMN role;
@@ -0,0 +1,3 @@
+ALTER TABLE webapp.user
+    ADD COLUMN IF NOT EXISTS role TEXT NOT NULL DEFAULT 'student'
+        CONSTRAINT user_role_check CHECK (role IN ('student', 'teacher', 'admin'));
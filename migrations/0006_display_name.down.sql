@@ -0,0 +1,3 @@
+ALTER TABLE webapp.user
+    DROP COLUMN display_name,
+    DROP COLUMN show_real_name;
@@ -0,0 +1,8 @@
+-- users without a display name are shown a default one made from their id
+ALTER TABLE webapp.user
+    ADD COLUMN IF NOT EXISTS display_name TEXT,
+    ADD COLUMN IF NOT EXISTS show_real_name BOOLEAN NOT NULL DEFAULT FALSE;
+
+-- display names differing only in case would be confused
+CREATE UNIQUE INDEX IF NOT EXISTS user_display_name_key
+    ON webapp.user (lower(display_name));
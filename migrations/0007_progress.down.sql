@@ -0,0 +1,3 @@
+DROP TABLE webapp.progress_history;
+DROP FUNCTION webapp.progress_history_append_only();
+DROP TABLE webapp.progress;
@@ -0,0 +1,40 @@
+-- constellations each user has learned, family counts are derived from these
+-- with the catalog so they can't disagree
+CREATE TABLE webapp.progress (
+    user_id       INTEGER NOT NULL REFERENCES webapp.user ON DELETE CASCADE,
+    constellation TEXT NOT NULL,
+    learned       TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, constellation)
+);
+
+-- every change to progress, rows are only ever added, and removed along with
+-- their user
+CREATE TABLE webapp.progress_history (
+    event_id      BIGSERIAL PRIMARY KEY,
+    user_id       INTEGER NOT NULL REFERENCES webapp.user ON DELETE CASCADE,
+    constellation TEXT NOT NULL,
+    event         TEXT NOT NULL
+        CONSTRAINT progress_history_event_check
+        CHECK (event IN ('learned', 'imported')),
+    recorded      TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX progress_history_user_id_idx
+    ON webapp.progress_history (user_id, recorded);
+
+-- rows can only be deleted by deleting their user, the cascade runs once the
+-- user row is already gone
+CREATE FUNCTION webapp.progress_history_append_only() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'DELETE' AND NOT EXISTS (
+        SELECT 1 FROM webapp.user WHERE user_id = OLD.user_id) THEN
+        RETURN OLD;
+    END IF;
+
+    RAISE EXCEPTION 'progress history can not be changed';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER progress_history_append_only
+    BEFORE UPDATE OR DELETE ON webapp.progress_history
+    FOR EACH ROW EXECUTE FUNCTION webapp.progress_history_append_only();
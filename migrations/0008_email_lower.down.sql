@@ -0,0 +1 @@
+DROP INDEX webapp.user_email_lower_key;
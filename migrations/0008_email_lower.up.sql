@@ -0,0 +1,4 @@
+-- addresses differing only in case reach the same mailbox, so they belong to
+-- one account, this fails if any are already registered twice and those have
+-- to be merged by hand first
+CREATE UNIQUE INDEX user_email_lower_key ON webapp.user (lower(email));
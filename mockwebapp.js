@@ -59,6 +59,14 @@ app.get('/families', function(req, res) {
     res.sendFile(__dirname + '/data/families.json');    
 });
 
+app.get('/asterisms', function(req, res) {
+    res.sendFile(__dirname + '/data/asterisms.json');
+});
+
+app.get('/user/progress', function(req, res) {
+    res.json([]);
+});
+
 app.get('/user/progress/:family', function(req, res) {
     // user id, family name
     var fam = req.params.family;
@@ -76,6 +84,10 @@ app.get('/user/profile', function(req, res) {
             firstName: "Joe",
             lastName: "Bloggs",
             email: "joe@bloggs.com",
+            emailVerified: true,
+            displayName: "Stargazer1",
+            showRealName: false,
+            role: "student",
             progress: userProgress
         });
     } else {
@@ -119,6 +131,22 @@ app.post('/user/logout', function(req, res) {
     res.json({message: "logged out"});
 });
 
+app.post('/user/password/forgot', function(req, res) {
+    res.json({message: "if the address is registered, a reset link has been sent"});
+});
+
+app.post('/user/password/reset', function(req, res) {
+    res.json({message: "password has been reset, please login"});
+});
+
+app.post('/user/verify', function(req, res) {
+    res.json({message: "email address has been verified"});
+});
+
+app.post('/user/verify/resend', function(req, res) {
+    res.json({message: "verification email has been sent"});
+});
+
 app.post('/leaderboard', function(req, res) {
     res.json({message: "foo"});
 });
@@ -0,0 +1,216 @@
+package main
+
+import (
+  "math"
+  "sort"
+  "github.com/gin-gonic/gin"
+)
+
+/******************************************************************************
+ * Constants
+ *****************************************************************************/
+
+const (
+    NumNeighbours int = 4
+)
+
+/******************************************************************************
+ * Type Declarations
+ *****************************************************************************/
+
+type Neighbour struct {
+    Short     string  `json:"short"`
+    Name      string  `json:"name"`
+    Direction string  `json:"direction"`
+    Distance  float64 `json:"distance"`
+}
+
+/******************************************************************************
+ * Helper functions
+ *****************************************************************************/
+
+// angular distance in radians between two points on the celestial sphere
+func angularDistance(ra1, dec1, ra2, dec2 float64) float64 {
+    sDiff := math.Sin(dec1) * math.Sin(dec2)
+    cDiff := math.Cos(dec1) * math.Cos(dec2) * math.Cos(ra1 - ra2)
+    return math.Acos(math.Max(-1, math.Min(1, sDiff + cDiff)))
+}
+
+// compass direction of the second point as seen from the first, using the
+// position angle measured from north through east
+func compassDirection(ra1, dec1, ra2, dec2 float64) string {
+    y := math.Sin(ra2 - ra1)
+    x := math.Cos(dec1) * math.Tan(dec2) - math.Sin(dec1) * math.Cos(ra2 - ra1)
+    angle := math.Atan2(y, x) * 180 / math.Pi
+
+    switch {
+    case angle >= -45 && angle < 45:
+        return "north"
+    case angle >= 45 && angle < 135:
+        return "east"
+    case angle >= -135 && angle < -45:
+        return "west"
+    default:
+        return "south"
+    }
+}
+
+// distance between the centroids of two constellations
+func constellationDistance(a, b Constellation) float64 {
+    return angularDistance(a.Ra, a.Dec, b.Ra, b.Dec)
+}
+
+// link every constellation to its nearest constellations by centroid, the
+// links are made symmetric so a neighbour always points back
+func (culture *SkyCulture) buildNeighbourGraph() {
+    constellations := culture.Constellations
+    links := make(map[string]map[string]bool)
+    for _, constellation := range constellations {
+        links[constellation.Short] = make(map[string]bool)
+    }
+
+    for _, constellation := range constellations {
+        others := make([]Constellation, 0, len(constellations))
+        for _, other := range constellations {
+            if other.Short != constellation.Short {
+                others = append(others, other)
+            }
+        }
+
+        // sort remaining constellations by distance between centroids
+        sort.Slice(others, func(i, j int) bool {
+            return constellationDistance(constellation, others[i]) <
+                   constellationDistance(constellation, others[j])
+        })
+
+        for i := 0; i < NumNeighbours && i < len(others); i++ {
+            links[constellation.Short][others[i].Short] = true
+            links[others[i].Short][constellation.Short] = true
+        }
+    }
+
+    // flatten to slices ordered nearest first
+    for short, set := range links {
+        origin, _ := culture.getConstellation(short)
+        neighbours := make([]string, 0, len(set))
+        for other := range set {
+            neighbours = append(neighbours, other)
+        }
+
+        sort.Slice(neighbours, func(i, j int) bool {
+            a, _ := culture.getConstellation(neighbours[i])
+            b, _ := culture.getConstellation(neighbours[j])
+            return constellationDistance(origin, a) <
+                   constellationDistance(origin, b)
+        })
+
+        culture.neighbourGraph[short] = neighbours
+    }
+}
+
+// describe a constellation relative to the one before it
+func getNeighbour(from, to Constellation) Neighbour {
+    return Neighbour{
+        Short:     to.Short,
+        Name:      to.Name,
+        Direction: compassDirection(from.Ra, from.Dec, to.Ra, to.Dec),
+        Distance:  constellationDistance(from, to),
+    }
+}
+
+// returns the neighbours of a constellation with their direction
+func (culture *SkyCulture) getNeighbours(
+    constellation Constellation) []Neighbour {
+    neighbours := make([]Neighbour, 0)
+    for _, short := range culture.neighbourGraph[constellation.Short] {
+        other, _ := culture.getConstellation(short)
+        neighbours = append(neighbours, getNeighbour(constellation, other))
+    }
+
+    return neighbours
+}
+
+// returns the shortest star-hopping route between two constellations as a
+// list of hops, or false if the target cannot be reached
+func (culture *SkyCulture) getStarHoppingRoute(
+    from, to Constellation) ([]Neighbour, bool) {
+    // breadth first search, neighbours are visited nearest first
+    previous := map[string]string{from.Short: ""}
+    queue := []string{from.Short}
+    for len(queue) > 0 && queue[0] != to.Short {
+        current := queue[0]
+        queue = queue[1:]
+
+        for _, next := range culture.neighbourGraph[current] {
+            if _, visited := previous[next]; !visited {
+                previous[next] = current
+                queue = append(queue, next)
+            }
+        }
+    }
+
+    if _, reached := previous[to.Short]; !reached {
+        return nil, false
+    }
+
+    // walk back from the target to rebuild the path
+    path := make([]string, 0)
+    for short := to.Short; short != ""; short = previous[short] {
+        path = append([]string{short}, path...)
+    }
+
+    route := make([]Neighbour, 0, len(path) - 1)
+    for i := 1; i < len(path); i++ {
+        prev, _ := culture.getConstellation(path[i - 1])
+        next, _ := culture.getConstellation(path[i])
+        route = append(route, getNeighbour(prev, next))
+    }
+
+    return route, true
+}
+
+/******************************************************************************
+ * Handlers
+ *****************************************************************************/
+
+func handleNeighbours(c *gin.Context) {
+    culture, found := getRequestCulture(c)
+    if !found {
+        return
+    }
+
+    constellation, found := culture.getConstellation(c.Param("short"))
+    if !found {
+        c.JSON(404, gin.H{"error": "constellation does not exist"})
+        return
+    }
+
+    c.JSON(200, culture.getNeighbours(constellation))
+}
+
+func handleStarHoppingRoute(c *gin.Context) {
+    culture, found := getRequestCulture(c)
+    if !found {
+        return
+    }
+
+    from, found := culture.getConstellation(c.Param("short"))
+    if !found {
+        c.JSON(404, gin.H{"error": "constellation does not exist"})
+        return
+    }
+
+    to, found := culture.getConstellation(c.Param("target"))
+    if !found {
+        c.JSON(404, gin.H{"error": "target constellation does not exist"})
+        return
+    }
+
+    route, found := culture.getStarHoppingRoute(from, to)
+    if !found {
+        c.JSON(404, gin.H{"error": "no route between constellations"})
+        return
+    }
+
+    c.JSON(200, gin.H{"from": from.Short, "to": to.Short, "route": route})
+}
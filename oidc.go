@@ -0,0 +1,514 @@
+package main
+
+import (
+  "context"
+  "database/sql"
+  "encoding/base64"
+  "encoding/json"
+  "errors"
+  "log"
+  "net/http"
+  "net/url"
+  "os"
+  "strings"
+  "sync"
+  "time"
+  "github.com/coreos/go-oidc/v3/oidc"
+  "github.com/gin-gonic/gin"
+  "github.com/garyburd/redigo/redis"
+  "golang.org/x/oauth2"
+)
+
+/******************************************************************************
+ * Constants
+ *****************************************************************************/
+
+const (
+    OIDCStateCookieName string        = "FIRMAMENT_OIDC"
+    OIDCStateBytes      int           = 32
+    OIDCStateMaxAge     time.Duration = time.Minute * 10
+    OIDCTimeout         time.Duration = time.Second * 10
+)
+
+/******************************************************************************
+ * Type Declarations
+ *****************************************************************************/
+
+// who an external provider says the user is
+type ExternalIdentity struct {
+    Subject       string
+    Email         string
+    EmailVerified bool
+    FirstName     string
+    LastName      string
+}
+
+// an external identity provider users can login with
+type LoginProvider interface {
+    // url to send the user to, which comes back to redirectURL with a code
+    AuthCodeURL(ctx context.Context, redirectURL string,
+                state string, nonce string) (string, error)
+
+    // trade the code for the identity of the user
+    Exchange(ctx context.Context, redirectURL string,
+             code string, nonce string) (*ExternalIdentity, error)
+}
+
+// provider as described in the -oidc file
+type OIDCConfig struct {
+    Id           string   `json:"id"`
+    Name         string   `json:"name"`
+    Issuer       string   `json:"issuer"`
+    ClientId     string   `json:"clientId"`
+    ClientSecret string   `json:"clientSecret"`
+    Scopes       []string `json:"scopes,omitempty"`
+}
+
+// openid connect provider, discovered on first use so an identity provider
+// being down doesn't stop us starting
+type OIDCProvider struct {
+    config   OIDCConfig
+    mutex    sync.Mutex
+    provider *oidc.Provider
+}
+
+// provider as listed to the client for login buttons
+type LoginProviderInfo struct {
+    Id   string `json:"id"`
+    Name string `json:"name"`
+}
+
+/******************************************************************************
+ * Global Variables
+ *****************************************************************************/
+
+// returned when an identity claims an existing account's unverified address
+var errUnverifiedEmail error = errors.New("an account with this email " +
+                                          "already exists, please login " +
+                                          "with your password")
+
+var (
+    loginProviders    map[string]LoginProvider = make(map[string]LoginProvider)
+    loginProviderList []LoginProviderInfo      = []LoginProviderInfo{}
+)
+
+/******************************************************************************
+ * OpenID Connect provider
+ *****************************************************************************/
+
+func NewOIDCProvider(config OIDCConfig) *OIDCProvider {
+    return &OIDCProvider{config: config}
+}
+
+// fetch the provider's discovery document, retried on the next call if it
+// fails
+func (p *OIDCProvider) discover(ctx context.Context) (*oidc.Provider, error) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+
+    if p.provider == nil {
+        provider, err := oidc.NewProvider(ctx, p.config.Issuer)
+        if err != nil {
+            return nil, err
+        }
+        p.provider = provider
+    }
+
+    return p.provider, nil
+}
+
+func (p *OIDCProvider) oauth2Config(provider *oidc.Provider,
+                                    redirectURL string) *oauth2.Config {
+    scopes := p.config.Scopes
+    if len(scopes) == 0 {
+        scopes = []string{"email", "profile"}
+    }
+
+    return &oauth2.Config{
+        ClientID:     p.config.ClientId,
+        ClientSecret: p.config.ClientSecret,
+        Endpoint:     provider.Endpoint(),
+        RedirectURL:  redirectURL,
+        Scopes:       append([]string{oidc.ScopeOpenID}, scopes...),
+    }
+}
+
+func (p *OIDCProvider) AuthCodeURL(ctx context.Context, redirectURL string,
+                                   state string, nonce string) (string, error) {
+    provider, err := p.discover(ctx)
+    if err != nil {
+        return "", err
+    }
+
+    config := p.oauth2Config(provider, redirectURL)
+    return config.AuthCodeURL(state, oidc.Nonce(nonce)), nil
+}
+
+func (p *OIDCProvider) Exchange(ctx context.Context, redirectURL string,
+                                code string, nonce string) (*ExternalIdentity, error) {
+    provider, err := p.discover(ctx)
+    if err != nil {
+        return nil, err
+    }
+
+    token, err := p.oauth2Config(provider, redirectURL).Exchange(ctx, code)
+    if err != nil {
+        return nil, err
+    }
+
+    // the id token is signed by the provider, check it was issued for us
+    // in answer to this login
+    rawToken, ok := token.Extra("id_token").(string)
+    if !ok {
+        return nil, errors.New("no id token in response")
+    }
+
+    verifier := provider.Verifier(&oidc.Config{ClientID: p.config.ClientId})
+    idToken, err := verifier.Verify(ctx, rawToken)
+    if err != nil {
+        return nil, err
+    }
+
+    if idToken.Nonce != nonce {
+        return nil, errors.New("id token nonce does not match")
+    }
+
+    var claims struct {
+        Email         string `json:"email"`
+        EmailVerified bool   `json:"email_verified"`
+        Name          string `json:"name"`
+        GivenName     string `json:"given_name"`
+        FamilyName    string `json:"family_name"`
+    }
+    if err = idToken.Claims(&claims); err != nil {
+        return nil, err
+    }
+
+    // fall back to splitting the full name if the parts aren't given
+    firstName, lastName := claims.GivenName, claims.FamilyName
+    if firstName == "" && lastName == "" {
+        names := strings.Fields(claims.Name)
+        if len(names) > 0 {
+            firstName = names[0]
+            lastName = strings.Join(names[1:], " ")
+        }
+    }
+
+    return &ExternalIdentity{idToken.Subject, claims.Email,
+                             claims.EmailVerified, firstName, lastName}, nil
+}
+
+/******************************************************************************
+ * Helper functions
+ *****************************************************************************/
+
+// read the providers users can login with
+func loadLoginProviders(path string) {
+    raw, err := os.ReadFile(path)
+    if err != nil {
+        log.Fatal("Failed to read login providers.")
+    }
+
+    var configs []OIDCConfig
+    if err = json.Unmarshal(raw, &configs); err != nil {
+        log.Fatal("Failed to parse login providers.")
+    }
+
+    providers := make(map[string]LoginProvider)
+    list := []LoginProviderInfo{}
+    for _, config := range configs {
+        if config.Id == "" || config.Issuer == "" || config.ClientId == "" {
+            log.Fatal("Login provider is missing id, issuer or client id.")
+        }
+
+        providers[config.Id] = NewOIDCProvider(config)
+        list = append(list, LoginProviderInfo{config.Id, config.Name})
+    }
+
+    loginProviders = providers
+    loginProviderList = list
+}
+
+// where the provider sends users back to, must be registered with it
+func oidcRedirectURL(providerId string) string {
+    return siteURL + "/user/oidc/" + url.PathEscape(providerId) + "/callback"
+}
+
+// remember the state and nonce of a login until the user comes back
+func createLoginState(providerId string) (string, string, error) {
+    stateBytes, err := generateRandomId(OIDCStateBytes)
+    if err != nil {
+        return "", "", err
+    }
+
+    nonceBytes, err := generateRandomId(OIDCStateBytes)
+    if err != nil {
+        return "", "", err
+    }
+
+    state := base64.URLEncoding.EncodeToString(stateBytes)
+    nonce := base64.URLEncoding.EncodeToString(nonceBytes)
+
+    con := stores.redisPool.Get()
+    defer con.Close()
+
+    ttl := int(OIDCStateMaxAge.Seconds())
+    key := "oidc:" + hashToken(stateBytes)
+    con.Send("MULTI")
+    con.Send("HSET", key, "provider", providerId, "nonce", nonce)
+    con.Send("EXPIRE", key, ttl)
+    if _, err = con.Do("EXEC"); err != nil {
+        return "", "", err
+    }
+
+    return state, nonce, nil
+}
+
+// return the nonce of a login started with this provider and forget it,
+// empty if there is no such login
+func consumeLoginState(providerId string, state string) string {
+    bytes, err := base64.URLEncoding.DecodeString(state)
+    if err != nil || len(bytes) != OIDCStateBytes {
+        return ""
+    }
+
+    con := stores.redisPool.Get()
+    defer con.Close()
+
+    key := "oidc:" + hashToken(bytes)
+    con.Send("MULTI")
+    con.Send("HMGET", key, "provider", "nonce")
+    con.Send("DEL", key)
+    r, err := redis.Values(con.Do("EXEC"))
+    if err != nil || len(r) != 2 {
+        return ""
+    }
+
+    fields, err := redis.Strings(r[0], nil)
+    if err != nil || len(fields) != 2 || fields[0] != providerId {
+        return ""
+    }
+
+    return fields[1]
+}
+
+// ties the login to the browser that started it
+func createLoginStateCookie(state string, maxAge int) *http.Cookie {
+    cookie := http.Cookie{}
+    cookie.Name = OIDCStateCookieName
+    cookie.Value = state
+    cookie.Path = "/user/oidc"
+    cookie.MaxAge = maxAge
+    cookie.Secure = true
+    cookie.HttpOnly = true
+    cookie.SameSite = http.SameSiteLaxMode
+    return &cookie
+}
+
+// find the user an external identity belongs to, linking it to the account
+// with the same email address if the provider has verified it, or creating
+// a new account otherwise, an unverified local account loses its password,
+// tokens and sessions when linked
+func linkExternalIdentity(providerId string, identity *ExternalIdentity) (int, error) {
+    var userId int
+    err := stores.sqlPool.QueryRow(
+        "SELECT user_id FROM webapp.user_identity " +
+        "WHERE provider=$1 AND subject=$2",
+        providerId, identity.Subject).Scan(&userId)
+    if err == nil {
+        return userId, nil
+    } else if err != sql.ErrNoRows {
+        return 0, err
+    }
+
+    if identity.Email == "" {
+        return 0, errors.New("provider did not share an email address")
+    }
+
+    tx, err := stores.sqlPool.Begin()
+    if err != nil {
+        return 0, err
+    }
+    defer tx.Rollback()
+
+    // addresses differing only in case belong to the same person
+    var localVerified bool
+    err = tx.QueryRow(
+        "SELECT user_id, email_verified FROM webapp.user " +
+        "WHERE lower(email)=lower($1)",
+        identity.Email).Scan(&userId, &localVerified)
+
+    takeover := false
+    if err == nil {
+        // anyone can claim an address, only trust it once verified
+        if !identity.EmailVerified {
+            return 0, errUnverifiedEmail
+        }
+
+        // whoever registered an unverified account may not own the address,
+        // shut them out before handing it to the one who proved they do
+        if !localVerified {
+            takeover = true
+            _, err = tx.Exec(
+                "UPDATE webapp.user SET password=NULL WHERE user_id=$1", userId)
+            if err == nil {
+                _, err = tx.Exec(
+                    "DELETE FROM webapp.api_token WHERE user_id=$1", userId)
+            }
+            if err == nil {
+                _, err = tx.Exec(
+                    "DELETE FROM webapp.user_identity WHERE user_id=$1", userId)
+            }
+        }
+
+        if err == nil {
+            _, err = tx.Exec(
+                "UPDATE webapp.user SET email_verified=TRUE WHERE user_id=$1",
+                userId)
+        }
+    } else if err == sql.ErrNoRows {
+        // names are required, make do with the address if none were given
+        firstName, lastName := identity.FirstName, identity.LastName
+        if firstName == "" {
+            firstName = strings.SplitN(identity.Email, "@", 2)[0]
+        }
+
+        // no password, the user can set one by resetting it
+        err = tx.QueryRow(
+            "INSERT INTO webapp.user(first_name, last_name, email, " +
+                                    "email_verified, registration_time, " +
+                                    "last_login) " +
+            "VALUES ($1, $2, $3, $4, NOW(), NOW()) RETURNING user_id",
+            firstName, lastName, identity.Email,
+            identity.EmailVerified).Scan(&userId)
+    }
+    if err != nil {
+        return 0, err
+    }
+
+    _, err = tx.Exec(
+        "INSERT INTO webapp.user_identity(provider, subject, user_id) " +
+        "VALUES ($1, $2, $3)", providerId, identity.Subject, userId)
+    if err == nil {
+        err = tx.Commit()
+    }
+    if err != nil {
+        return 0, err
+    }
+
+    // sessions live in redis, so can only go once the takeover is committed
+    if takeover {
+        if err = deleteUserSessions(userId); err != nil {
+            return 0, err
+        }
+    }
+
+    return userId, nil
+}
+
+// send the browser back to the site, with an error to show if any
+func redirectAfterLogin(c *gin.Context, message string) {
+    http.SetCookie(c.Writer, createLoginStateCookie("", -1))
+    if message == "" {
+        c.Redirect(302, siteURL + "/")
+    } else {
+        c.Redirect(302, siteURL + "/?loginError=" + url.QueryEscape(message))
+    }
+}
+
+/******************************************************************************
+ * Handlers
+ *****************************************************************************/
+
+func handleLoginProviders(c *gin.Context) {
+    c.JSON(200, loginProviderList)
+}
+
+func handleOIDCLogin(c *gin.Context) {
+    providerId := c.Param("provider")
+    provider, ok := loginProviders[providerId]
+    if !ok {
+        c.JSON(404, gin.H{"error": "login provider not found"})
+        return
+    }
+
+    state, nonce, err := createLoginState(providerId)
+    if err != nil {
+        c.JSON(500, gin.H{"error": "unexpected error occurred"})
+        return
+    }
+
+    ctx, cancel := context.WithTimeout(c.Request.Context(), OIDCTimeout)
+    defer cancel()
+
+    authURL, err := provider.AuthCodeURL(ctx, oidcRedirectURL(providerId),
+                                         state, nonce)
+    if err != nil {
+        log.Println("login provider " + providerId + " unavailable:", err)
+        c.JSON(502, gin.H{"error": "login provider is unavailable"})
+        return
+    }
+
+    maxAge := int(OIDCStateMaxAge.Seconds())
+    http.SetCookie(c.Writer, createLoginStateCookie(state, maxAge))
+    c.Redirect(302, authURL)
+}
+
+func handleOIDCCallback(c *gin.Context) {
+    providerId := c.Param("provider")
+    provider, ok := loginProviders[providerId]
+    if !ok {
+        c.JSON(404, gin.H{"error": "login provider not found"})
+        return
+    }
+
+    // the user may have refused or the provider failed
+    if c.Query("error") != "" {
+        redirectAfterLogin(c, "login was cancelled")
+        return
+    }
+
+    // state must be the one given to this browser, so nobody can log the
+    // user in to an account of their choosing
+    state := c.Query("state")
+    cookie, err := c.Request.Cookie(OIDCStateCookieName)
+    if err != nil || cookie.Value != state {
+        redirectAfterLogin(c, "login has expired, please try again")
+        return
+    }
+
+    nonce := consumeLoginState(providerId, state)
+    if nonce == "" {
+        redirectAfterLogin(c, "login has expired, please try again")
+        return
+    }
+
+    ctx, cancel := context.WithTimeout(c.Request.Context(), OIDCTimeout)
+    defer cancel()
+
+    identity, err := provider.Exchange(ctx, oidcRedirectURL(providerId),
+                                       c.Query("code"), nonce)
+    if err != nil {
+        log.Println("login with " + providerId + " failed:", err)
+        redirectAfterLogin(c, "login failed, please try again")
+        return
+    }
+
+    userId, err := linkExternalIdentity(providerId, identity)
+    if err == errUnverifiedEmail {
+        redirectAfterLogin(c, err.Error())
+        return
+    } else if err != nil {
+        log.Println("linking " + providerId + " identity failed:", err)
+        redirectAfterLogin(c, "login failed, please try again")
+        return
+    }
+
+    if !createUserSession(c, userId) {
+        redirectAfterLogin(c, "unexpected error occurred")
+        return
+    }
+    recordLogin(userId)
+
+    redirectAfterLogin(c, "")
+}
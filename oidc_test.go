@@ -0,0 +1,214 @@
+package main
+
+import (
+  "context"
+  "crypto/rand"
+  "crypto/rsa"
+  "database/sql"
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "net/url"
+  "testing"
+  "time"
+  "github.com/DATA-DOG/go-sqlmock"
+  "github.com/go-jose/go-jose/v4"
+  "github.com/stretchr/testify/assert"
+)
+
+// minimal openid connect provider signing whatever nonce it was given
+func newStandInProvider(t *testing.T, clientId string) *httptest.Server {
+    key, err := rsa.GenerateKey(rand.Reader, 2048)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    signer, err := jose.NewSigner(jose.SigningKey{
+        Algorithm: jose.RS256,
+        Key:       jose.JSONWebKey{Key: key, KeyID: "test"},
+    }, nil)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // codes handed out by the authorization endpoint, mapped to the nonce
+    codes := make(map[string]string)
+    mux := http.NewServeMux()
+    server := httptest.NewServer(mux)
+
+    mux.HandleFunc("/.well-known/openid-configuration",
+                   func(w http.ResponseWriter, r *http.Request) {
+        json.NewEncoder(w).Encode(map[string]interface{}{
+            "issuer":                 server.URL,
+            "authorization_endpoint": server.URL + "/authorize",
+            "token_endpoint":         server.URL + "/token",
+            "jwks_uri":               server.URL + "/keys",
+            "id_token_signing_alg_values_supported": []string{"RS256"},
+        })
+    })
+
+    mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+        json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+            {Key: &key.PublicKey, KeyID: "test", Algorithm: "RS256", Use: "sig"},
+        }})
+    })
+
+    mux.HandleFunc("/authorize", func(w http.ResponseWriter, r *http.Request) {
+        codes["code-1"] = r.URL.Query().Get("nonce")
+        http.Redirect(w, r, r.URL.Query().Get("redirect_uri") +
+                      "?code=code-1&state=" + r.URL.Query().Get("state"), 302)
+    })
+
+    mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+        r.ParseForm()
+        nonce, ok := codes[r.PostForm.Get("code")]
+        if !ok {
+            http.Error(w, `{"error":"invalid_grant"}`, 400)
+            return
+        }
+
+        claims, _ := json.Marshal(map[string]interface{}{
+            "iss":            server.URL,
+            "sub":            "pupil-42",
+            "aud":            clientId,
+            "exp":            time.Now().Add(time.Hour).Unix(),
+            "iat":            time.Now().Unix(),
+            "nonce":          nonce,
+            "email":          "pupil@school.example",
+            "email_verified": true,
+            "name":           "Ada Lovelace",
+        })
+        signed, _ := signer.Sign(claims)
+        idToken, _ := signed.CompactSerialize()
+
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(map[string]interface{}{
+            "access_token": "access",
+            "token_type":   "Bearer",
+            "expires_in":   3600,
+            "id_token":     idToken,
+        })
+    })
+
+    return server
+}
+
+func TestOIDCProvider(t *testing.T) {
+    assert := assert.New(t)
+    server := newStandInProvider(t, "firmament")
+    defer server.Close()
+
+    provider := NewOIDCProvider(OIDCConfig{Id: "school", Issuer: server.URL,
+                                           ClientId: "firmament",
+                                           ClientSecret: "secret"})
+    ctx := context.Background()
+    redirectURL := "https://firmament.test/user/oidc/school/callback"
+
+    // login url carries our client, state and nonce
+    authURL, err := provider.AuthCodeURL(ctx, redirectURL, "state-1", "nonce-1")
+    assert.Nil(err)
+    parsed, _ := url.Parse(authURL)
+    assert.Equal("firmament", parsed.Query().Get("client_id"))
+    assert.Equal("state-1", parsed.Query().Get("state"))
+    assert.Equal("nonce-1", parsed.Query().Get("nonce"))
+
+    // follow the login to get a code
+    client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+        return http.ErrUseLastResponse
+    }}
+    resp, err := client.Get(authURL)
+    assert.Nil(err)
+    callback, _ := url.Parse(resp.Header.Get("Location"))
+    assert.Equal("state-1", callback.Query().Get("state"))
+
+    // code is exchanged for a verified identity
+    identity, err := provider.Exchange(ctx, redirectURL,
+                                       callback.Query().Get("code"), "nonce-1")
+    assert.Nil(err)
+    assert.Equal("pupil-42", identity.Subject)
+    assert.Equal("pupil@school.example", identity.Email)
+    assert.True(identity.EmailVerified)
+    assert.Equal("Ada", identity.FirstName)
+    assert.Equal("Lovelace", identity.LastName)
+
+    // id token issued for another login is refused
+    _, err = provider.Exchange(ctx, redirectURL,
+                               callback.Query().Get("code"), "nonce-2")
+    assert.NotNil(err)
+
+    // unknown codes are refused by the provider
+    _, err = provider.Exchange(ctx, redirectURL, "bogus", "nonce-1")
+    assert.NotNil(err)
+}
+
+func TestLinkExternalIdentity(t *testing.T) {
+    assert := assert.New(t)
+    mr, mock := useTestStores(t)
+    identity := &ExternalIdentity{Subject: "pupil-42",
+                                  Email: "Pupil@School.example",
+                                  EmailVerified: true}
+
+    // an unverified account registered by someone else with the address is
+    // taken from them before it is linked
+    cookie := testSession(t, 5)
+    mock.ExpectQuery("FROM webapp.user_identity").
+        WithArgs("school", "pupil-42").WillReturnError(sql.ErrNoRows)
+    mock.ExpectBegin()
+    mock.ExpectQuery("WHERE lower\\(email\\)=lower\\(\\$1\\)").
+        WithArgs("Pupil@School.example").
+        WillReturnRows(sqlmock.NewRows([]string{"user_id", "email_verified"}).
+                       AddRow(5, false))
+    mock.ExpectExec("SET password=NULL").WithArgs(5).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec("DELETE FROM webapp.api_token").WithArgs(5).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec("DELETE FROM webapp.user_identity").WithArgs(5).
+        WillReturnResult(sqlmock.NewResult(0, 0))
+    mock.ExpectExec("SET email_verified=TRUE").WithArgs(5).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec("INSERT INTO webapp.user_identity").
+        WithArgs("school", "pupil-42", 5).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
+
+    userId, err := linkExternalIdentity("school", identity)
+    assert.Nil(err)
+    assert.Equal(5, userId)
+    assert.Nil(mock.ExpectationsWereMet())
+    assert.False(mr.Exists("session:" + sessionTokenHash(cookie.Value)))
+
+    // a verified account is linked as it is
+    cookie = testSession(t, 6)
+    mock.ExpectQuery("FROM webapp.user_identity").
+        WithArgs("school", "pupil-42").WillReturnError(sql.ErrNoRows)
+    mock.ExpectBegin()
+    mock.ExpectQuery("WHERE lower\\(email\\)=lower\\(\\$1\\)").
+        WillReturnRows(sqlmock.NewRows([]string{"user_id", "email_verified"}).
+                       AddRow(6, true))
+    mock.ExpectExec("SET email_verified=TRUE").WithArgs(6).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectExec("INSERT INTO webapp.user_identity").
+        WithArgs("school", "pupil-42", 6).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    mock.ExpectCommit()
+
+    userId, err = linkExternalIdentity("school", identity)
+    assert.Nil(err)
+    assert.Equal(6, userId)
+    assert.Nil(mock.ExpectationsWereMet())
+    assert.True(mr.Exists("session:" + sessionTokenHash(cookie.Value)))
+
+    // addresses the provider hasn't verified are never linked
+    identity.EmailVerified = false
+    mock.ExpectQuery("FROM webapp.user_identity").
+        WillReturnError(sql.ErrNoRows)
+    mock.ExpectBegin()
+    mock.ExpectQuery("WHERE lower\\(email\\)=lower\\(\\$1\\)").
+        WillReturnRows(sqlmock.NewRows([]string{"user_id", "email_verified"}).
+                       AddRow(6, true))
+    mock.ExpectRollback()
+
+    _, err = linkExternalIdentity("school", identity)
+    assert.Equal(errUnverifiedEmail, err)
+    assert.Nil(mock.ExpectationsWereMet())
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+  "database/sql"
+  "encoding/base64"
+  "log"
+  "regexp"
+  "time"
+  "github.com/gin-gonic/gin"
+  "github.com/garyburd/redigo/redis"
+  "golang.org/x/crypto/bcrypt"
+)
+
+/******************************************************************************
+ * Constants
+ *****************************************************************************/
+
+const (
+    ResetTokenBytes  int           = 32
+    ResetTokenMaxAge time.Duration = time.Hour
+    DefaultSiteURL   string        = "https://firmament.space"
+)
+
+/******************************************************************************
+ * Global Variables
+ *****************************************************************************/
+
+// public address of the site used in links sent by email, never taken from
+// the request as the Host header can't be trusted
+var siteURL string = DefaultSiteURL
+
+/******************************************************************************
+ * Helper functions
+ *****************************************************************************/
+
+// create a single use password reset token for the user, only its hash is
+// stored so a leaked database can't be used to reset passwords
+func createResetToken(userId int) (string, error) {
+    bytes, err := generateRandomId(ResetTokenBytes)
+    if err != nil {
+        return "", err
+    }
+
+    con := stores.redisPool.Get()
+    defer con.Close()
+
+    ttl := int(ResetTokenMaxAge.Seconds())
+    _, err = con.Do("SET", "reset:" + hashToken(bytes), userId, "EX", ttl)
+    if err != nil {
+        return "", err
+    }
+
+    return base64.URLEncoding.EncodeToString(bytes), nil
+}
+
+// return the user id a reset token was issued for and delete the token so it
+// can't be used again, 0 if the token is invalid or expired
+func consumeResetToken(token string) int {
+    bytes, err := base64.URLEncoding.DecodeString(token)
+    if err != nil || len(bytes) != ResetTokenBytes {
+        return 0
+    }
+
+    con := stores.redisPool.Get()
+    defer con.Close()
+
+    // get and delete atomically so concurrent resets can't both succeed
+    key := "reset:" + hashToken(bytes)
+    con.Send("MULTI")
+    con.Send("GET", key)
+    con.Send("DEL", key)
+    r, err := redis.Values(con.Do("EXEC"))
+    if err != nil || len(r) != 2 || r[0] == nil {
+        return 0
+    }
+
+    userId, err := redis.Int(r[0], nil)
+    if err != nil {
+        return 0
+    }
+
+    return userId
+}
+
+// email a password reset link to the user
+func sendResetMail(emailAddr string, token string) error {
+    body := "Someone asked to reset the password of your Firmament account.\n\n" +
+            "Follow this link within the hour to choose a new password:\n\n" +
+            siteURL + "/?reset=" + token + "\n\n" +
+            "If this wasn't you, you can safely ignore this email."
+    return mailer.Send(emailAddr, "Reset your Firmament password", body)
+}
+
+/******************************************************************************
+ * Handlers
+ *****************************************************************************/
+
+func handleForgotPassword(c *gin.Context) {
+    emailAddr := c.PostForm("email")
+
+    // check email address
+    re := regexp.MustCompile(EmailAddrRegex)
+    if !re.Match([]byte(emailAddr)) {
+        c.JSON(400, gin.H{"error": "invalid email address"})
+        return
+    }
+
+    // always answer the same way so accounts can't be discovered
+    response := gin.H{"message": "if the address is registered, " +
+                                 "a reset link has been sent"}
+
+    // the account is looked up and mailed after answering, so known and
+    // unknown addresses take as long
+    sendMailLater("password reset mail", func() error {
+        var userId int
+        var email string
+        err := stores.sqlPool.QueryRow(
+            "SELECT user_id, email FROM webapp.user " +
+            "WHERE lower(email)=lower($1)", emailAddr).Scan(&userId, &email)
+        if err == sql.ErrNoRows {
+            return nil
+        } else if err != nil {
+            return err
+        }
+
+        token, err := createResetToken(userId)
+        if err != nil {
+            return err
+        }
+        return sendResetMail(email, token)
+    })
+
+    c.JSON(200, response)
+}
+
+func handleResetPassword(c *gin.Context) {
+    token    := c.PostForm("token")
+    password := c.PostForm("password")
+
+    // check password before using up the token
+    if len(password) < 1 {
+        c.JSON(400, gin.H{"error": "password is missing"})
+        return
+    }
+
+    userId := consumeResetToken(token)
+    if userId <= 0 {
+        c.JSON(400, gin.H{"error": "reset link is invalid or has expired"})
+        return
+    }
+
+    // bcrypt password
+    hash, err := bcrypt.GenerateFromPassword([]byte(password), BcryptCostFactor)
+    if err != nil {
+        c.JSON(500, gin.H{"error": "an error occurred, please try again"})
+        return
+    }
+
+    _, err = stores.sqlPool.Exec(
+        "UPDATE webapp.user SET password=$1 WHERE user_id=$2", hash, userId)
+    if err != nil {
+        c.JSON(500, gin.H{"error": "an error occurred, please try again"})
+        return
+    }
+
+    // whoever knew the old password must not stay logged in
+    if err = deleteUserSessions(userId); err != nil {
+        log.Println("failed to delete sessions after reset:", err)
+    }
+
+    c.JSON(200, gin.H{"message": "password has been reset, please login"})
+}
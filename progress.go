@@ -0,0 +1,340 @@
+package main
+
+import (
+  "fmt"
+  "log"
+  "strconv"
+  "strings"
+  "time"
+  "github.com/gin-gonic/gin"
+  "github.com/garyburd/redigo/redis"
+  "github.com/lib/pq"
+)
+
+/******************************************************************************
+ * Constants
+ *****************************************************************************/
+
+// why a constellation was added to a user's progress
+const (
+    ProgressLearned  string = "learned"
+    ProgressImported string = "imported"
+)
+
+/******************************************************************************
+ * Type Declarations
+ *****************************************************************************/
+
+type FamilyProgress struct {
+    Name      string `json:"name"`
+    Completed uint64 `json:"completed"`
+    Total     uint64 `json:"total"`
+}
+
+type LearnedConstellation struct {
+    Name    string    `json:"name"`
+    Family  string    `json:"family"`
+    Learned time.Time `json:"learned"`
+}
+
+type ProgressEvent struct {
+    Constellation string    `json:"constellation"`
+    Event         string    `json:"event"`
+    Recorded      time.Time `json:"recorded"`
+}
+
+/******************************************************************************
+ * Helper functions
+ *****************************************************************************/
+
+// add constellations to a user's progress and history, those already learned
+// are left as they were, returns how many were new
+func learnConstellations(userId int, names []string, event string) (int64, error) {
+    r, err := stores.sqlPool.Exec(
+        "WITH learned AS (" +
+        "INSERT INTO webapp.progress(user_id, constellation) " +
+        "SELECT $1, unnest($2::text[]) ON CONFLICT DO NOTHING " +
+        "RETURNING user_id, constellation, learned) " +
+        "INSERT INTO webapp.progress_history(user_id, constellation, event, " +
+                                            "recorded) " +
+        "SELECT user_id, constellation, $3, learned FROM learned",
+        userId, pq.Array(names), event)
+    if err != nil {
+        return 0, err
+    }
+
+    return r.RowsAffected()
+}
+
+// updates the progress for named family, either with the constellations
+// learned or with a count of them in the order they are taught, progress
+// is never lost so a lower count changes nothing
+func setUserProgress(userId int, familyName string, names []string,
+                     count uint64) (bool, error) {
+    // check if familyName is valid
+    members, ok := defaultCulture.familyConstellations[familyName]
+    if !ok || count > uint64(len(members)) {
+        return false, nil
+    }
+
+    // every constellation named has to be in the family
+    for _, name := range names {
+        if defaultCulture.constellationFamily[name] != familyName {
+            return false, nil
+        }
+    }
+
+    names = append(names, members[:count]...)
+    if len(names) == 0 {
+        return true, nil
+    }
+
+    _, err := learnConstellations(userId, names, ProgressLearned)
+    return true, err
+}
+
+// returns the constellations a user has learned in the order they were,
+// including those no longer in the catalog
+func listLearnedConstellations(userId int) ([]LearnedConstellation, error) {
+    rows, err := stores.sqlPool.Query(
+        "SELECT constellation, learned FROM webapp.progress " +
+        "WHERE user_id=$1 ORDER BY learned, constellation", userId)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    learned := []LearnedConstellation{}
+    for rows.Next() {
+        var l LearnedConstellation
+        if err = rows.Scan(&l.Name, &l.Learned); err != nil {
+            return nil, err
+        }
+
+        l.Family = defaultCulture.constellationFamily[l.Name]
+        learned = append(learned, l)
+    }
+
+    return learned, rows.Err()
+}
+
+// returns every change made to a user's progress, oldest first
+func listProgressHistory(userId int) ([]ProgressEvent, error) {
+    rows, err := stores.sqlPool.Query(
+        "SELECT constellation, event, recorded FROM webapp.progress_history " +
+        "WHERE user_id=$1 ORDER BY recorded, event_id", userId)
+    if err != nil {
+        return nil, err
+    }
+    defer rows.Close()
+
+    history := []ProgressEvent{}
+    for rows.Next() {
+        var e ProgressEvent
+        if err = rows.Scan(&e.Constellation, &e.Event, &e.Recorded); err != nil {
+            return nil, err
+        }
+        history = append(history, e)
+    }
+
+    return history, rows.Err()
+}
+
+// return FamilyProgress containing user progress for named family
+func getUserProgress(userId int, familyName string) (FamilyProgress, error) {
+    var completed uint64
+    err := stores.sqlPool.QueryRow(
+        "SELECT count(*) FROM webapp.progress " +
+        "WHERE user_id=$1 AND constellation = ANY($2)", userId,
+        pq.Array(defaultCulture.familyConstellations[familyName])).Scan(&completed)
+    if err != nil {
+        return FamilyProgress{}, err
+    }
+
+    total := defaultCulture.familySize[familyName]
+    return FamilyProgress{familyName, completed, total}, nil
+}
+
+// retuns FamilyProgress array containing user progress for all families
+func getTotalUserProgress(userId int) ([]FamilyProgress, error) {
+    learned, err := listLearnedConstellations(userId)
+    if err != nil {
+        return nil, err
+    }
+
+    completed := make(map[string]uint64)
+    for _, l := range learned {
+        completed[l.Family]++
+    }
+
+    progress := make([]FamilyProgress, 0)
+    for _, family := range defaultCulture.Families {
+        progress = append(progress, FamilyProgress{family.Name,
+            completed[family.Name], defaultCulture.familySize[family.Name]})
+    }
+
+    return progress, nil
+}
+
+// move progress counters kept in redis before it was stored in postgres,
+// each counter is removed once its constellations are recorded so this can
+// be run again after a failure
+func importRedisProgress() error {
+    con := stores.redisPool.Get()
+    defer con.Close()
+
+    // collect keys first, the scan is unreliable while deleting
+    keys := []string{}
+    cursor := 0
+    for {
+        r, err := redis.Values(con.Do("SCAN", cursor, "MATCH", "progress:*",
+                                      "COUNT", 100))
+        if err != nil {
+            return err
+        }
+        if len(r) != 2 {
+            return fmt.Errorf("unexpected reply to scan")
+        }
+
+        cursor, _ = redis.Int(r[0], nil)
+        batch, _ := redis.Strings(r[1], nil)
+        keys = append(keys, batch...)
+
+        if cursor == 0 {
+            break
+        }
+    }
+
+    imported, skipped := 0, 0
+    for _, key := range keys {
+        // progress:<userId>:<family>
+        parts := strings.SplitN(key, ":", 3)
+        if len(parts) != 3 {
+            log.Println("Skipping " + key + ", not a progress counter")
+            skipped++
+            continue
+        }
+
+        userId, err := strconv.Atoi(parts[1])
+        members, ok := defaultCulture.familyConstellations[parts[2]]
+        if err != nil || !ok {
+            log.Println("Skipping " + key + ", unknown user or family")
+            skipped++
+            continue
+        }
+
+        count, err := redis.Int(con.Do("GET", key))
+        if err == redis.ErrNil {
+            continue
+        } else if err != nil || count < 0 {
+            log.Println("Skipping " + key + ", not a progress counter")
+            skipped++
+            continue
+        }
+        if count > len(members) {
+            count = len(members)
+        }
+
+        // counters of deleted users are dropped
+        var exists bool
+        err = stores.sqlPool.QueryRow(
+            "SELECT EXISTS(SELECT 1 FROM webapp.user WHERE user_id=$1)",
+            userId).Scan(&exists)
+        if err != nil {
+            return err
+        }
+
+        if exists && count > 0 {
+            _, err = learnConstellations(userId, members[:count], ProgressImported)
+            if err != nil {
+                return fmt.Errorf("importing %s failed: %v", key, err)
+            }
+        }
+
+        if _, err = con.Do("DEL", key); err != nil {
+            return err
+        }
+        imported++
+    }
+
+    fmt.Printf("Imported %d progress counters, skipped %d\n", imported, skipped)
+    return nil
+}
+
+/******************************************************************************
+ * Handlers
+ *****************************************************************************/
+
+func handleGetLearned(c *gin.Context) {
+    // get userid of logged in user, abort if 0
+    userId, _ := getLoggedInUser(c)
+    if userId <= 0 {
+        c.JSON(401, gin.H{"error": "not logged in"})
+        return
+    }
+
+    learned, err := listLearnedConstellations(userId)
+    if err != nil {
+        c.JSON(500, gin.H{"error": "no progress"})
+        return
+    }
+
+    c.JSON(200, learned)
+}
+
+func handleGetProgress(c *gin.Context) {
+    // get userid of logged in user, abort if 0
+    userId, _ := getLoggedInUser(c)
+    if userId <= 0 {
+        c.JSON(401, gin.H{"error": "not logged in"})
+        return
+    }
+
+    familyName    := c.Param("family")
+    progress, err := getUserProgress(userId, familyName)
+    if err != nil {
+        c.JSON(500, gin.H{"error": "no progress"})
+        return
+    }
+
+    c.JSON(200, progress)
+}
+
+func handleSetProgress(c *gin.Context) {
+    // get userid of logged in user, abort if 0
+    userId, _ := getLoggedInUser(c)
+    if userId <= 0 {
+        c.JSON(401, gin.H{"error": "not logged in"})
+        return
+    }
+
+    // constellations learned, or how many of the family have been
+    familyName := c.Param("family")
+    names := c.PostFormArray("constellation")
+
+    var newProgress uint64
+    var err error
+    if value, ok := c.GetPostForm("progress"); ok {
+        newProgress, err = strconv.ParseUint(value, 10, 64)
+        if err != nil {
+            c.JSON(400, gin.H{"error": "invalid progress value"})
+            return
+        }
+    } else if len(names) == 0 {
+        c.JSON(400, gin.H{"error": "invalid progress value"})
+        return
+    }
+
+    valid, err := setUserProgress(userId, familyName, names, newProgress)
+    if err != nil {
+        c.JSON(500, gin.H{"error": "unexpected error occurred"})
+        return
+    }
+
+    if !valid {
+        c.JSON(400, gin.H{"error": "invalid progress value"})
+        return
+    }
+
+    c.JSON(200, gin.H{"message": "progress has been updated"})
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+  "log"
+  "math/rand"
+  "strconv"
+  "strings"
+  "time"
+  "github.com/gin-gonic/gin"
+  "github.com/garyburd/redigo/redis"
+)
+
+/******************************************************************************
+ * Constants
+ *****************************************************************************/
+
+const (
+    LockoutThreshold int           = 5
+    LockoutBase      time.Duration = time.Minute
+    LockoutMax       time.Duration = time.Hour * 24
+    LockoutWindow    time.Duration = time.Hour * 24
+
+    // a whole school can share one address behind nat, so limits by address
+    // let a large class through at once and guessing passwords is left to
+    // the limits by account and the lockout
+    ClassroomSize int = 250
+
+    RegisterIPLimit      int = ClassroomSize * 2 // per hour
+    LoginIPLimit         int = ClassroomSize * 2 // per minute, with retries
+    LoginAccountLimit    int = 10                // per minute
+    PasswordIPLimit      int = ClassroomSize     // per hour
+    PasswordAccountLimit int = 10                // per hour
+    ForgotIPLimit        int = ClassroomSize     // per hour
+    ForgotAccountLimit   int = 3                 // per hour
+    LobbyIPLimit         int = ClassroomSize     // per minute
+    LobbyAccountLimit    int = 10                // per minute
+)
+
+/******************************************************************************
+ * Type Declarations
+ *****************************************************************************/
+
+// identifies who a request is limited as, an empty key is not limited
+type RateLimitKey func(c *gin.Context) string
+
+/******************************************************************************
+ * Helper functions
+ *****************************************************************************/
+
+// address of the client, forwarded addresses are only believed from the
+// proxies given by -trustedproxies
+func byClientIP(c *gin.Context) string {
+    return c.ClientIP()
+}
+
+// account named in the email form field, so attempts against one account
+// from many addresses are counted together
+func byEmail(c *gin.Context) string {
+    return normalizeEmail(c.PostForm("email"))
+}
+
+// logged in user, so changes made from one account are counted together
+// whichever address they come from
+func byUser(c *gin.Context) string {
+    if userId, _ := getLoggedInUser(c); userId > 0 {
+        return strconv.Itoa(userId)
+    }
+
+    return ""
+}
+
+// email addresses differing only in case or spacing name the same account
+func normalizeEmail(emailAddr string) string {
+    return strings.ToLower(strings.TrimSpace(emailAddr))
+}
+
+// record a request in a sliding window log and return how long to wait if
+// there have been more than limit in the last window
+func rateLimitWait(key string, limit int, window time.Duration) (time.Duration, error) {
+    con := stores.redisPool.Get()
+    defer con.Close()
+
+    // log every request including rejected ones, hammering keeps you out
+    now := time.Now().UnixNano()
+    member := strconv.FormatInt(now, 10) + ":" + strconv.Itoa(rand.Int())
+    con.Send("MULTI")
+    con.Send("ZREMRANGEBYSCORE", key, "-inf", now - int64(window))
+    con.Send("ZADD", key, now, member)
+    con.Send("ZCARD", key)
+    con.Send("PEXPIRE", key, int64(window / time.Millisecond))
+    r, err := redis.Values(con.Do("EXEC"))
+    if err != nil || len(r) != 4 {
+        return 0, err
+    }
+
+    count, _ := redis.Int(r[2], nil)
+    if count <= limit {
+        return 0, nil
+    }
+
+    // the window holds count requests including this one, oldest first, so
+    // the next is allowed once count - limit + 1 have left it, the last of
+    // those being at index count - limit
+    values, err := redis.Strings(con.Do("ZRANGE", key, count - limit,
+                                        count - limit, "WITHSCORES"))
+    if err != nil || len(values) != 2 {
+        return window, err
+    }
+
+    // replies are member then score
+    score, err := strconv.ParseFloat(values[1], 64)
+    if err != nil {
+        return window, err
+    }
+
+    return time.Duration(int64(score) + int64(window) - now), nil
+}
+
+// round a wait up to whole seconds for Retry-After
+func retryAfter(wait time.Duration) string {
+    seconds := int64((wait + time.Second - 1) / time.Second)
+    if seconds < 1 {
+        seconds = 1
+    }
+
+    return strconv.FormatInt(seconds, 10)
+}
+
+// time an account is locked for after a number of consecutive failed logins,
+// doubling with every failure past the threshold
+func lockoutDuration(failures int) time.Duration {
+    if failures < LockoutThreshold {
+        return 0
+    }
+
+    shift := uint(failures - LockoutThreshold)
+    if shift > 16 || LockoutBase << shift > LockoutMax {
+        return LockoutMax
+    }
+
+    return LockoutBase << shift
+}
+
+// count a failed login against an account and lock it once over threshold
+func recordLoginFailure(emailAddr string) {
+    con := stores.redisPool.Get()
+    defer con.Close()
+
+    key := normalizeEmail(emailAddr)
+    con.Send("MULTI")
+    con.Send("INCR", "login-failures:" + key)
+    con.Send("EXPIRE", "login-failures:" + key, int(LockoutWindow.Seconds()))
+    r, err := redis.Ints(con.Do("EXEC"))
+    if err != nil || len(r) != 2 {
+        return
+    }
+
+    if lockout := lockoutDuration(r[0]); lockout > 0 {
+        con.Do("SET", "lockout:" + key, 1, "PX", int64(lockout / time.Millisecond))
+    }
+}
+
+// forget failed logins against an account once someone gets in
+func clearLoginFailures(emailAddr string) {
+    con := stores.redisPool.Get()
+    defer con.Close()
+
+    con.Do("DEL", "login-failures:" + normalizeEmail(emailAddr))
+}
+
+/******************************************************************************
+ * Middleware
+ *****************************************************************************/
+
+// allow at most limit requests per key in any window, requests over it get
+// a 429, if redis is down requests are let through rather than locking
+// everyone out
+func RateLimit(name string, limit int, window time.Duration,
+               key RateLimitKey) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        id := key(c)
+        if id == "" {
+            return
+        }
+
+        wait, err := rateLimitWait("ratelimit:" + name + ":" + id, limit, window)
+        if err != nil {
+            log.Println("rate limit unavailable:", err)
+            return
+        }
+
+        if wait > 0 {
+            c.Header("Retry-After", retryAfter(wait))
+            c.AbortWithStatusJSON(429, gin.H{"error": "too many requests, " +
+                                                      "please try again later"})
+        }
+    }
+}
+
+// refuse logins to an account locked by too many failed attempts
+func LoginLockout(c *gin.Context) {
+    id := byEmail(c)
+    if id == "" {
+        return
+    }
+
+    con := stores.redisPool.Get()
+    defer con.Close()
+
+    ttl, err := redis.Int64(con.Do("PTTL", "lockout:" + id))
+    if err != nil || ttl <= 0 {
+        return
+    }
+
+    c.Header("Retry-After", retryAfter(time.Duration(ttl) * time.Millisecond))
+    c.AbortWithStatusJSON(429, gin.H{"error": "too many failed logins, " +
+                                              "please try again later"})
+}
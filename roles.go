@@ -0,0 +1,211 @@
+package main
+
+import (
+  "database/sql"
+  "fmt"
+  "os"
+  "strconv"
+  "github.com/gin-gonic/gin"
+)
+
+/******************************************************************************
+ * Constants
+ *****************************************************************************/
+
+// roles are ordered, each can do everything the ones before it can
+const (
+    RoleStudent string = "student"
+    RoleTeacher string = "teacher"
+    RoleAdmin   string = "admin"
+)
+
+/******************************************************************************
+ * Global Variables
+ *****************************************************************************/
+
+var roleRank map[string]int = map[string]int{
+    RoleStudent: 1,
+    RoleTeacher: 2,
+    RoleAdmin:   3,
+}
+
+/******************************************************************************
+ * Helper functions
+ *****************************************************************************/
+
+// returns the role of a user
+func getUserRole(userId int) (string, error) {
+    var role string
+    err := stores.sqlPool.QueryRow(
+        "SELECT role FROM webapp.user WHERE user_id=$1", userId).Scan(&role)
+    return role, err
+}
+
+// check if a role includes the privileges of another
+func hasRole(role string, required string) bool {
+    return roleRank[role] >= roleRank[required] && roleRank[role] > 0
+}
+
+/******************************************************************************
+ * Middleware
+ *****************************************************************************/
+
+// only let users with at least the given role through, the role is read on
+// every request so changes apply at once
+func RequireRole(required string) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        // get userid of logged in user, abort if 0
+        userId, _ := getLoggedInUser(c)
+        if userId <= 0 {
+            c.AbortWithStatusJSON(401, gin.H{"error": "not logged in"})
+            return
+        }
+
+        role, err := getUserRole(userId)
+        if err != nil {
+            c.AbortWithStatusJSON(500, gin.H{"error": "unexpected error occurred"})
+            return
+        }
+
+        if !hasRole(role, required) {
+            c.AbortWithStatusJSON(403, gin.H{"error": "permission denied"})
+            return
+        }
+    }
+}
+
+/******************************************************************************
+ * Handlers
+ *****************************************************************************/
+
+func handleListUsers(c *gin.Context) {
+    // optionally only those with a role
+    role := c.Query("role")
+    if role != "" && roleRank[role] == 0 {
+        c.JSON(400, gin.H{"error": "unknown role"})
+        return
+    }
+
+    rows, err := stores.sqlPool.Query(
+        "SELECT user_id, first_name, last_name, email, role " +
+        "FROM webapp.user WHERE $1='' OR role=$1 ORDER BY user_id", role)
+    if err != nil {
+        c.JSON(500, gin.H{"error": "unexpected error occurred"})
+        return
+    }
+    defer rows.Close()
+
+    users := []gin.H{}
+    for rows.Next() {
+        var userId int
+        var firstName, lastName, email, userRole string
+        err = rows.Scan(&userId, &firstName, &lastName, &email, &userRole)
+        if err != nil {
+            c.JSON(500, gin.H{"error": "unexpected error occurred"})
+            return
+        }
+
+        users = append(users, gin.H{"id": userId, "firstName": firstName,
+                                    "lastName": lastName, "email": email,
+                                    "role": userRole})
+    }
+
+    c.JSON(200, users)
+}
+
+func handleSetRole(c *gin.Context) {
+    adminId, _ := getLoggedInUser(c)
+    userId, err := strconv.Atoi(c.Param("user"))
+    if err != nil {
+        c.JSON(404, gin.H{"error": "user not found"})
+        return
+    }
+
+    role := c.PostForm("role")
+    if roleRank[role] == 0 {
+        c.JSON(400, gin.H{"error": "unknown role"})
+        return
+    }
+
+    // there must always be someone left to hand out roles
+    if userId == adminId && role != RoleAdmin {
+        c.JSON(400, gin.H{"error": "you can't remove your own admin role"})
+        return
+    }
+
+    r, err := stores.sqlPool.Exec(
+        "UPDATE webapp.user SET role=$1 WHERE user_id=$2", role, userId)
+    if err != nil {
+        c.JSON(500, gin.H{"error": "unexpected error occurred"})
+        return
+    }
+
+    if rows, _ := r.RowsAffected(); rows != 1 {
+        c.JSON(404, gin.H{"error": "user not found"})
+        return
+    }
+
+    // sessions from before the change must not carry new privileges
+    if err = deleteUserSessions(userId); err != nil {
+        c.JSON(500, gin.H{"error": "role changed but sessions could not " +
+                                   "be revoked"})
+        return
+    }
+
+    c.JSON(200, gin.H{"message": "role has been updated"})
+}
+
+/******************************************************************************
+ * Router Group for /admin/*
+ *****************************************************************************/
+
+// setup /admin routes, only for admins
+func adminRoutes(admin *gin.RouterGroup) {
+    admin.Use(RequireRole(RoleAdmin))
+
+    admin.GET("/users", handleListUsers)
+    admin.POST("/users/:user/role", handleSetRole)
+    admin.POST("/users/:user/display-name/reset", handleResetDisplayName)
+}
+
+/******************************************************************************
+ * Command
+ *****************************************************************************/
+
+// firmament role <email> student | teacher | admin, the only way to create
+// the first admin as roles are otherwise handed out by admins
+func roleCommand(args []string) int {
+    usage := "usage: firmament [flags] role <email> student | teacher | admin"
+    if len(args) != 2 || roleRank[args[1]] == 0 {
+        fmt.Fprintln(os.Stderr, usage)
+        return 2
+    }
+
+    emailAddr, role := args[0], args[1]
+    if err := checkSchema(stores.sqlPool); err != nil {
+        fmt.Fprintln(os.Stderr, err)
+        return 1
+    }
+
+    var userId int
+    err := stores.sqlPool.QueryRow(
+        "UPDATE webapp.user SET role=$1 WHERE lower(email)=lower($2) " +
+        "RETURNING user_id", role, emailAddr).Scan(&userId)
+    if err == sql.ErrNoRows {
+        fmt.Fprintln(os.Stderr, "No user with email address " + emailAddr)
+        return 1
+    } else if err != nil {
+        fmt.Fprintln(os.Stderr, "Failed to set role:", err)
+        return 1
+    }
+
+    // sessions from before the change must not carry new privileges
+    if err = deleteUserSessions(userId); err != nil {
+        fmt.Fprintln(os.Stderr, "Role changed but sessions could not be " +
+                                "revoked:", err)
+        return 1
+    }
+
+    fmt.Printf("User %d %s is now %s\n", userId, emailAddr, role)
+    return 0
+}
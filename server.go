@@ -6,6 +6,8 @@ import (
   "time"
   "log"
   "math/rand"
+  "os"
+  "strings"
   "database/sql"
   "github.com/gin-gonic/gin"
   "github.com/patrickmn/go-cache"
@@ -13,19 +15,53 @@ import (
   _ "github.com/lib/pq"
 )
 
+// command line arguments
+var (
+    noCache     = flag.Bool("nocache", false, "disable web server cache")
+    cacheBudget = flag.Int("cachebudget", CacheBudgetDefault,
+                           "web server cache memory budget in megabytes")
+    sharedCache = flag.Bool("sharedcache", false,
+                            "share web server cache between instances in redis")
+    siteDir     = flag.String("sitedir", "",
+                              "serve data and assets from this directory " +
+                              "instead of those built into the binary")
+    smtpAddr    = flag.String("smtp", "",
+                              "smtp relay host:port used to send email, " +
+                              "email is logged instead if not given")
+    mailFrom    = flag.String("mailfrom", "Firmament <noreply@firmament.space>",
+                              "sender address of email")
+    mailLog     = flag.String("maillog", "",
+                              "append email to this file instead of the log " +
+                              "when no smtp relay is given")
+    siteAddr    = flag.String("siteurl", DefaultSiteURL,
+                              "public url of the site used in email links " +
+                              "and login redirects")
+    oidcFile    = flag.String("oidc", "",
+                              "json file listing openid connect providers " +
+                              "users can login with")
+    proxies     = flag.String("trustedproxies", "",
+                              "comma separated addresses or cidr ranges of " +
+                              "proxies whose X-Forwarded-For is believed, " +
+                              "none if not given")
+)
+
 var stores struct {
-    redisPool  *redis.Pool
-    sqlPool    *sql.DB
-    cacheStore *cache.Cache
-    lobbyStore *cache.Cache
+    redisPool     *redis.Pool
+    sqlPool       *sql.DB
+    responseStore *ResponseCache
+    sharedStore   *SharedCache
+    lobbyStore    *cache.Cache
 }
 
 // setup cache store / postgres and redis connection pools
 func init() {
-    // create in-memory store for cache
-    stores.cacheStore = cache.New(5*time.Minute, 30*time.Second)
+    // create in-memory store for lobbies
     stores.lobbyStore = cache.New(24*time.Hour,  30*time.Second)
 
+    // bounded store for cached responses, budget is set once flags are parsed
+    stores.responseStore = NewResponseCache(CacheMaxEntries,
+                                            int64(CacheBudgetDefault) << 20)
+
     // this will always return a valid pool, errors gracefully on access
     stores.redisPool = redis.NewPool(func() (redis.Conn, error) {
             return redis.Dial("unix", "/var/run/redis/redis.sock")
@@ -45,16 +81,63 @@ func init() {
 // create and setup the gin engine
 func GetRouter() *gin.Engine {
     // parse command line arguments
-    noCache := flag.Bool("nocache", false, "disable web server cache")
     flag.Parse()
 
+    // read catalog and assets, from disk if asked to
+    if (*siteDir != "") {
+        fmt.Println("Serving data and assets from " + *siteDir)
+    }
+    loadSite(*siteDir)
+
+    // send email through a relay if given, credentials come from the
+    // environment so they don't show up in the process list
+    siteURL = strings.TrimSuffix(*siteAddr, "/")
+    if (*smtpAddr != "") {
+        smtpMailer, err := NewSMTPMailer(*smtpAddr, *mailFrom,
+                                         os.Getenv("FIRMAMENT_SMTP_USER"),
+                                         os.Getenv("FIRMAMENT_SMTP_PASSWORD"))
+        if err != nil {
+            log.Fatal("Invalid sender address " + *mailFrom + ".")
+        }
+        mailer = smtpMailer
+    } else {
+        fmt.Println("Email will be logged instead of sent")
+        mailer = &LogMailer{Path: *mailLog}
+    }
+
+    // external login providers
+    if (*oidcFile != "") {
+        loadLoginProviders(*oidcFile)
+    }
+
     // create new router
     r := gin.Default()
 
+    // client addresses are used for rate limits, so only take them from
+    // headers set by our own proxies
+    trusted := []string(nil)
+    if (*proxies != "") {
+        trusted = strings.Split(*proxies, ",")
+    }
+    if err := r.SetTrustedProxies(trusted); err != nil {
+        log.Fatal("Invalid trusted proxies " + *proxies + ".")
+    }
+
+    // compress every route, cached ones reuse their stored variants
+    r.Use(Compress)
+
     // use cache unless disabled
     if (*noCache) {
         fmt.Println("Web server cache has been disabled")
     }
+    stores.responseStore.SetBudget(int64(*cacheBudget) << 20)
+
+    // add redis tier to cache if running several instances
+    if (*sharedCache && !*noCache && stores.sharedStore == nil) {
+        fmt.Println("Web server cache is shared through redis")
+        stores.sharedStore = NewSharedCache(stores.redisPool)
+        stores.sharedStore.Start()
+    }
 
     // base routes
     base := r.Group("/")
@@ -64,15 +147,32 @@ func GetRouter() *gin.Engine {
     baseRoutes(base)
 
     // user routes
-    userRoutes(r.Group("/user"))
-    leaderboardRoutes(r.Group("/leaderboard"))
-    lobbyRoutes(r.Group("/lobby"))
+    userRoutes(r.Group("/user", CSRFProtect))
+    leaderboardRoutes(r.Group("/leaderboard", CSRFProtect))
+    lobbyRoutes(r.Group("/lobby", CSRFProtect))
+    adminRoutes(r.Group("/admin", CSRFProtect))
+    cacheRoutes(r.Group("/cache", CSRFProtect))
 
     // return router
     return r
 }
 
 func main() {
+    // schema changes and roles are set by separate commands, after any
+    // flags so they can point them at the site data
+    flag.Parse()
+    switch flag.Arg(0) {
+    case "migrate":
+        os.Exit(migrateCommand(flag.Args()[1:]))
+    case "role":
+        os.Exit(roleCommand(flag.Args()[1:]))
+    }
+
+    // refuse to start against a schema other than the one built for
+    if err := checkSchema(stores.sqlPool); err != nil {
+        log.Fatal(err)
+    }
+
     // listen and serve on 0.0.0.0:8080
     gin.SetMode(gin.ReleaseMode)
     GetRouter().Run()
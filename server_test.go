@@ -1,13 +1,115 @@
 package main
 
 import (
+  "archive/zip"
+  "bytes"
+  "encoding/base64"
+  "database/sql"
+  "encoding/json"
+  "errors"
+  "io"
+  "os"
+  "regexp"
+  "github.com/DATA-DOG/go-sqlmock"
+  "github.com/alicebob/miniredis/v2"
+  "github.com/garyburd/redigo/redis"
   "github.com/stretchr/testify/assert"
   "github.com/gin-gonic/gin"
+  "github.com/lib/pq"
+  "golang.org/x/crypto/bcrypt"
   "net/http"
   "net/http/httptest"
+  "net/url"
+  "strconv"
+  "strings"
   "testing"
+  "testing/fstest"
+  "time"
 )
 
+func TestMain(m *testing.M) {
+    // catalog is normally loaded by GetRouter
+    loadSite("")
+    os.Exit(m.Run())
+}
+
+// swap redis and postgres for in-memory stand-ins for the length of a test
+func useTestStores(t *testing.T) (*miniredis.Miniredis, sqlmock.Sqlmock) {
+    mr := miniredis.RunT(t)
+    db, mock, err := sqlmock.New()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    redisPool, sqlPool := stores.redisPool, stores.sqlPool
+    stores.redisPool = redis.NewPool(func() (redis.Conn, error) {
+            return redis.Dial("tcp", mr.Addr())
+        }, 4)
+    stores.sqlPool = db
+    t.Cleanup(func() {
+        stores.redisPool, stores.sqlPool = redisPool, sqlPool
+        db.Close()
+    })
+
+    return mr, mock
+}
+
+// write mail to a file for the length of a test, returns its path
+func useTestMailer(t *testing.T) string {
+    path := t.TempDir() + "/mail.log"
+    previous := mailer
+    mailer = &LogMailer{Path: path}
+    t.Cleanup(func() { mailer = previous })
+    return path
+}
+
+// log a user in without going through the database, returns the cookie
+func testSession(t *testing.T, userId int) *http.Cookie {
+    resp := httptest.NewRecorder()
+    c, _ := gin.CreateTestContext(resp)
+    c.Request, _ = http.NewRequest("POST", "/user/login", nil)
+    if !createUserSession(c, userId) {
+        t.Fatal("failed to create session")
+    }
+
+    return findCookie(resp, SessionCookieName)
+}
+
+// returns the cookie set on a response, nil if there isn't one
+func findCookie(resp *httptest.ResponseRecorder, name string) *http.Cookie {
+    for _, cookie := range resp.Result().Cookies() {
+        if cookie.Name == name {
+            return cookie
+        }
+    }
+
+    return nil
+}
+
+// make a request as our own pages would, with a csrf token and any cookies
+func testRequest(router *gin.Engine, method string, path string,
+                 form url.Values, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+    var body io.Reader
+    if form != nil {
+        body = strings.NewReader(form.Encode())
+    }
+
+    req := httptest.NewRequest(method, path, body)
+    if form != nil {
+        req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    }
+    req.AddCookie(createCSRFCookie("test-token"))
+    req.Header.Set(CSRFHeaderName, "test-token")
+    req.Header.Set("Origin", DefaultSiteURL)
+    for _, cookie := range cookies {
+        req.AddCookie(cookie)
+    }
+
+    resp := httptest.NewRecorder()
+    router.ServeHTTP(resp, req)
+    return resp
+}
+
 func TestPing(t *testing.T) {
     // setup request
     req, _ := http.NewRequest("GET", "/ping", nil)
@@ -24,4 +126,1067 @@ func TestPing(t *testing.T) {
 
     // verify body contents
     assert.Equal("{\"message\":\"pong\"}\n", resp.Body.String(), "body does not match")
-}
\ No newline at end of file
+}
+
+func TestConstellation(t *testing.T) {
+    // setup request
+    req, _ := http.NewRequest("GET", "/constellations/ori", nil)
+    resp := httptest.NewRecorder()
+
+    // serve request
+    gin.SetMode(gin.ReleaseMode)
+    GetRouter().ServeHTTP(resp, req)
+
+    // check response code
+    assert := assert.New(t)
+    assert.Equal(200, resp.Code, "response code not as expected")
+
+    // verify resolved fields
+    var detail ConstellationDetail
+    assert.Nil(json.Unmarshal(resp.Body.Bytes(), &detail))
+    assert.Equal("Orion", detail.Name)
+    assert.Equal(uint64(1), detail.Level)
+    assert.NotEmpty(detail.Stars)
+    assert.True(len(detail.Neighbours) >= NumNeighbours)
+    assert.NotContains(detail.Neighbours, "Ori")
+    for _, star := range detail.Stars {
+        assert.True(detail.Brightest.Mag <= star.Mag)
+    }
+}
+
+func TestConstellationNotFound(t *testing.T) {
+    req, _ := http.NewRequest("GET", "/constellations/xyz", nil)
+    resp := httptest.NewRecorder()
+
+    gin.SetMode(gin.ReleaseMode)
+    GetRouter().ServeHTTP(resp, req)
+
+    assert.Equal(t, 404, resp.Code, "response code not as expected")
+}
+
+func TestStarHoppingRoute(t *testing.T) {
+    req, _ := http.NewRequest("GET", "/constellations/Ori/route/UMi", nil)
+    resp := httptest.NewRecorder()
+
+    gin.SetMode(gin.ReleaseMode)
+    GetRouter().ServeHTTP(resp, req)
+
+    assert := assert.New(t)
+    assert.Equal(200, resp.Code, "response code not as expected")
+
+    // every hop must be a neighbour of the previous constellation
+    var body struct {
+        Route []Neighbour `json:"route"`
+    }
+    assert.Nil(json.Unmarshal(resp.Body.Bytes(), &body))
+    assert.NotEmpty(body.Route)
+
+    previous := "Ori"
+    for _, hop := range body.Route {
+        assert.Contains(defaultCulture.neighbourGraph[previous], hop.Short)
+        previous = hop.Short
+    }
+    assert.Equal("UMi", previous)
+}
+
+func TestAsterisms(t *testing.T) {
+    assert := assert.New(t)
+
+    // every asterism edge must resolve to a catalog star
+    assert.NotEmpty(defaultCulture.Asterisms)
+    for _, asterism := range defaultCulture.Asterisms {
+        for _, edge := range asterism.Edges {
+            _, start := starIndex[edge.Start]
+            _, end := starIndex[edge.End]
+            assert.True(start && end, asterism.Name + " has unknown star")
+        }
+    }
+
+    // asterisms are found by name regardless of case
+    plough, found := defaultCulture.getAsterism("plough")
+    assert.True(found)
+    assert.Equal("Plough", plough.Name)
+}
+
+func TestSkyCultures(t *testing.T) {
+    assert := assert.New(t)
+
+    // constellation lines of every culture must resolve to catalog stars
+    for _, culture := range skyCultures {
+        assert.NotEmpty(culture.Constellations, culture.Id)
+        for _, constellation := range culture.Constellations {
+            for _, edge := range constellation.Edges {
+                _, start := starIndex[edge.Start]
+                _, end := starIndex[edge.End]
+                assert.True(start && end, constellation.Name + " has unknown star")
+            }
+        }
+    }
+
+    // culture is selected with the query string
+    req, _ := http.NewRequest("GET", "/constellations/shen?culture=chinese", nil)
+    resp := httptest.NewRecorder()
+
+    gin.SetMode(gin.ReleaseMode)
+    GetRouter().ServeHTTP(resp, req)
+    assert.Equal(200, resp.Code, "response code not as expected")
+
+    req, _ = http.NewRequest("GET", "/constellations?culture=unknown", nil)
+    resp = httptest.NewRecorder()
+    GetRouter().ServeHTTP(resp, req)
+    assert.Equal(404, resp.Code, "response code not as expected")
+}
+
+func TestCatalogVersion(t *testing.T) {
+    assert := assert.New(t)
+    router := GetRouter()
+
+    // first request is tagged with the catalog version
+    req, _ := http.NewRequest("GET", "/families", nil)
+    resp := httptest.NewRecorder()
+    router.ServeHTTP(resp, req)
+
+    etag := resp.Header().Get("ETag")
+    assert.Equal(200, resp.Code, "response code not as expected")
+    assert.Equal("\"" + catalogVersion + "\"", etag)
+    assert.Equal(catalogVersion, resp.Header().Get("X-Catalog-Version"))
+
+    // revalidating with the same tag returns no body
+    for i := 0; i < 2; i++ {
+        req, _ = http.NewRequest("GET", "/families", nil)
+        req.Header.Set("If-None-Match", etag)
+        resp = httptest.NewRecorder()
+        router.ServeHTTP(resp, req)
+
+        assert.Equal(304, resp.Code, "response code not as expected")
+        assert.Empty(resp.Body.String())
+    }
+
+    // a stale tag gets the full response
+    req, _ = http.NewRequest("GET", "/families", nil)
+    req.Header.Set("If-None-Match", "\"stale\"")
+    resp = httptest.NewRecorder()
+    router.ServeHTTP(resp, req)
+    assert.Equal(200, resp.Code, "response code not as expected")
+    assert.NotEmpty(resp.Body.String())
+}
+
+func TestFingerprintedAssets(t *testing.T) {
+    assert := assert.New(t)
+    router := GetRouter()
+
+    // index references assets by content hash
+    req, _ := http.NewRequest("GET", "/", nil)
+    resp := httptest.NewRecorder()
+    router.ServeHTTP(resp, req)
+
+    url := fingerprintedURL("css/bootstrap.css")
+    assert.Equal(200, resp.Code, "response code not as expected")
+    assert.Contains(resp.Body.String(), "href=\"" + url + "\"")
+    assert.Contains(resp.Body.String(), "urlArgs")
+
+    // fingerprinted urls never change, plain ones are revalidated
+    req, _ = http.NewRequest("GET", "/" + url, nil)
+    resp = httptest.NewRecorder()
+    router.ServeHTTP(resp, req)
+    assert.Equal(200, resp.Code, "response code not as expected")
+    assert.Equal(ImmutableCacheControl, resp.Header().Get("Cache-Control"))
+
+    req, _ = http.NewRequest("GET", "/assets/css/bootstrap.css", nil)
+    resp = httptest.NewRecorder()
+    router.ServeHTTP(resp, req)
+    assert.Equal(AssetCacheControl, resp.Header().Get("Cache-Control"))
+}
+
+func TestLogMailer(t *testing.T) {
+    assert := assert.New(t)
+    path := t.TempDir() + "/mail.log"
+    logMailer := &LogMailer{Path: path}
+
+    // line breaks can't be used to inject headers
+    err := logMailer.Send("user@example.com\r\nBcc: evil@example.com",
+                          "Reset your password", "follow the link")
+    assert.Nil(err)
+
+    raw, err := os.ReadFile(path)
+    assert.Nil(err)
+    assert.Contains(string(raw), "To: user@example.comBcc: evil@example.com\r\n")
+    assert.Contains(string(raw), "Subject: Reset your password\r\n")
+    assert.Contains(string(raw), "\r\n\r\nfollow the link")
+}
+
+func TestSMTPMailerSender(t *testing.T) {
+    assert := assert.New(t)
+
+    // only the bare address is used as the envelope sender
+    smtpMailer, err := NewSMTPMailer("localhost:25",
+                                     "Firmament <noreply@firmament.space>",
+                                     "", "")
+    assert.Nil(err)
+    assert.Equal("noreply@firmament.space", smtpMailer.sender)
+    assert.Equal("Firmament <noreply@firmament.space>", smtpMailer.From)
+
+    _, err = NewSMTPMailer("localhost:25", "not an address", "", "")
+    assert.NotNil(err)
+}
+
+// mailer which can never deliver
+type failingMailer struct{}
+
+func (m failingMailer) Send(to string, subject string, body string) error {
+    return errors.New("relay unavailable")
+}
+
+func TestForgotPassword(t *testing.T) {
+    assert := assert.New(t)
+    gin.SetMode(gin.ReleaseMode)
+    router := GetRouter()
+    _, mock := useTestStores(t)
+    mailPath := useTestMailer(t)
+    form := url.Values{"email": {"ada@example.com"}}
+
+    // known and unknown addresses get the same answer
+    mock.ExpectQuery("SELECT user_id, email FROM webapp.user").
+        WithArgs("ada@example.com").
+        WillReturnRows(sqlmock.NewRows([]string{"user_id", "email"}).
+                       AddRow(3, "ada@example.com"))
+    known := testRequest(router, "POST", "/user/password/forgot", form)
+    assert.Equal(200, known.Code, "response code not as expected")
+    pendingMail.Wait()
+
+    mock.ExpectQuery("SELECT user_id, email FROM webapp.user").
+        WillReturnError(sql.ErrNoRows)
+    unknown := testRequest(router, "POST", "/user/password/forgot", form)
+    assert.Equal(200, unknown.Code, "response code not as expected")
+    assert.Equal(known.Body.String(), unknown.Body.String())
+    pendingMail.Wait()
+
+    // even when the mail can't be sent
+    mailer = failingMailer{}
+    mock.ExpectQuery("SELECT user_id, email FROM webapp.user").
+        WillReturnRows(sqlmock.NewRows([]string{"user_id", "email"}).
+                       AddRow(3, "ada@example.com"))
+    failed := testRequest(router, "POST", "/user/password/forgot", form)
+    assert.Equal(200, failed.Code, "response code not as expected")
+    assert.Equal(known.Body.String(), failed.Body.String())
+    pendingMail.Wait()
+
+    // the link that was sent resets the password once
+    raw, _ := os.ReadFile(mailPath)
+    match := regexp.MustCompile("\\?reset=([A-Za-z0-9_=-]+)").FindStringSubmatch(string(raw))
+    assert.NotNil(match)
+    mock.ExpectExec("UPDATE webapp.user SET password").
+        WithArgs(sqlmock.AnyArg(), 3).WillReturnResult(sqlmock.NewResult(0, 1))
+    reset := url.Values{"token": {match[1]}, "password": {"new password"}}
+    resp := testRequest(router, "POST", "/user/password/reset", reset)
+    assert.Equal(200, resp.Code, "response code not as expected")
+    resp = testRequest(router, "POST", "/user/password/reset", reset)
+    assert.Equal(400, resp.Code, "response code not as expected")
+    assert.Nil(mock.ExpectationsWereMet())
+}
+
+func TestApiTokenScopes(t *testing.T) {
+    assert := assert.New(t)
+    bytes, _ := generateRandomId(ApiTokenBytes)
+    token := ApiTokenPrefix + base64.URLEncoding.EncodeToString(bytes)
+
+    // only our own well formed tokens are looked up
+    assert.Equal(hashToken(bytes), apiTokenHash(token))
+    assert.Empty(apiTokenHash(token[len(ApiTokenPrefix):]))
+    assert.Empty(apiTokenHash(ApiTokenPrefix + "short"))
+    assert.Equal([]string{ScopeProgress, ScopeLobby},
+                 parseTokenScopes([]string{"lobby", "admin", "progress", "lobby"}))
+
+    // routes without a scope never accept tokens
+    req, _ := http.NewRequest("GET", "/user/sessions", nil)
+    req.Header.Set("Authorization", "Bearer " + token)
+    resp := httptest.NewRecorder()
+    gin.SetMode(gin.ReleaseMode)
+    GetRouter().ServeHTTP(resp, req)
+    assert.Equal(401, resp.Code, "response code not as expected")
+}
+
+func TestCSRFProtect(t *testing.T) {
+    assert := assert.New(t)
+    gin.SetMode(gin.ReleaseMode)
+    router := GetRouter()
+
+    // reading hands out a token
+    req, _ := http.NewRequest("GET", "/user/profile", nil)
+    resp := httptest.NewRecorder()
+    router.ServeHTTP(resp, req)
+    var token string
+    for _, cookie := range resp.Result().Cookies() {
+        if cookie.Name == CSRFCookieName {
+            token = cookie.Value
+        }
+    }
+    assert.NotEmpty(token)
+
+    // state changing requests without the token are refused
+    req, _ = http.NewRequest("POST", "/user/logout", nil)
+    req.AddCookie(createCSRFCookie(token))
+    resp = httptest.NewRecorder()
+    router.ServeHTTP(resp, req)
+    assert.Equal(403, resp.Code, "response code not as expected")
+
+    // as are those from other sites, even with it
+    req, _ = http.NewRequest("POST", "/user/logout", nil)
+    req.AddCookie(createCSRFCookie(token))
+    req.Header.Set(CSRFHeaderName, token)
+    req.Header.Set("Origin", "https://evil.example")
+    resp = httptest.NewRecorder()
+    router.ServeHTTP(resp, req)
+    assert.Equal(403, resp.Code, "response code not as expected")
+
+    // with the token the request reaches the handler
+    req, _ = http.NewRequest("POST", "/user/logout", nil)
+    req.AddCookie(createCSRFCookie(token))
+    req.Header.Set(CSRFHeaderName, token)
+    req.Header.Set("Origin", DefaultSiteURL)
+    resp = httptest.NewRecorder()
+    router.ServeHTTP(resp, req)
+    assert.Equal(401, resp.Code, "response code not as expected")
+}
+
+func TestZipUserExport(t *testing.T) {
+    assert := assert.New(t)
+    export := &UserExport{
+        User:     ExportedUser{UserId: 7, FirstName: "Ada", LastName: "Lovelace",
+                               Email: "ada@example.com", Role: RoleTeacher},
+        Progress: []FamilyProgress{{"Ursa Major", 3, 10}},
+    }
+
+    raw, err := zipUserExport(export)
+    assert.Nil(err)
+
+    // one csv per table, never a password
+    archive, err := zip.NewReader(bytes.NewReader(raw), int64(len(raw)))
+    assert.Nil(err)
+    files := make(map[string]string)
+    for _, file := range archive.File {
+        reader, _ := file.Open()
+        contents, _ := io.ReadAll(reader)
+        files[file.Name] = string(contents)
+    }
+
+    assert.Contains(files, "sessions.csv")
+    assert.Contains(files["user.csv"], "7,Ada,Lovelace,ada@example.com,false")
+    assert.Contains(files["user.csv"], ",teacher,")
+    assert.NotContains(files["user.csv"], "password")
+    assert.Contains(files["progress.csv"], "Ursa Major,3,10")
+}
+
+func TestSetProgressValidation(t *testing.T) {
+    assert := assert.New(t)
+
+    // constellations of a family are in the order they are taught
+    assert.Equal([]string{"Orion", "Lepus", "Canis Major", "Monoceros",
+                          "Canis Minor"},
+                 defaultCulture.familyConstellations["Orion"])
+    assert.Equal("Orion", defaultCulture.constellationFamily["Lepus"])
+
+    // rejected before anything is stored
+    for _, c := range []struct {
+        family string
+        names  []string
+        count  uint64
+    }{
+        {"Nowhere", nil, 0},
+        {"Orion", nil, 6},
+        {"Orion", []string{"Lepus", "Ursa Major"}, 0},
+    } {
+        valid, err := setUserProgress(1, c.family, c.names, c.count)
+        assert.False(valid)
+        assert.Nil(err)
+    }
+}
+
+func TestRequireRole(t *testing.T) {
+    assert := assert.New(t)
+
+    // roles include the privileges of those below them
+    assert.True(hasRole(RoleAdmin, RoleTeacher))
+    assert.True(hasRole(RoleTeacher, RoleTeacher))
+    assert.False(hasRole(RoleStudent, RoleTeacher))
+    assert.False(hasRole("", RoleStudent))
+
+    // debug routes need a logged in admin
+    for _, path := range []string{"/user/redis", "/user/pgsql", "/admin/users"} {
+        req, _ := http.NewRequest("GET", path, nil)
+        resp := httptest.NewRecorder()
+        gin.SetMode(gin.ReleaseMode)
+        GetRouter().ServeHTTP(resp, req)
+        assert.Equal(401, resp.Code, "response code not as expected")
+    }
+}
+
+func TestCheckDisplayName(t *testing.T) {
+    assert := assert.New(t)
+
+    assert.Empty(checkDisplayName("orion_hunter"))
+    assert.NotEmpty(checkDisplayName("ab"))
+    assert.NotEmpty(checkDisplayName("has space"))
+
+    // default names belong to the user with that id
+    assert.NotEmpty(checkDisplayName("stargazer42"))
+
+    // blocked words are caught through look-alike characters
+    assert.NotEmpty(checkDisplayName("sh1t_head"))
+    assert.NotEmpty(checkDisplayName("Big-W4NK"))
+}
+
+func TestLoadMigrations(t *testing.T) {
+    assert := assert.New(t)
+
+    // those built in are numbered from one with an up and down each
+    migrations, err := loadMigrations(migrationFiles)
+    assert.Nil(err)
+    assert.NotEmpty(migrations)
+    for i, migration := range migrations {
+        assert.Equal(i + 1, migration.Version)
+        assert.NotEmpty(migration.Up)
+        assert.NotEmpty(migration.Down)
+    }
+
+    sql := []byte("SELECT 1;")
+    _, err = loadMigrations(fstest.MapFS{
+        "migrations/0001_a.up.sql":   {Data: sql},
+        "migrations/0001_a.down.sql": {Data: sql},
+        "migrations/0003_c.up.sql":   {Data: sql},
+        "migrations/0003_c.down.sql": {Data: sql},
+    })
+    assert.NotNil(err, "gap in versions not noticed")
+
+    _, err = loadMigrations(fstest.MapFS{
+        "migrations/0001_a.up.sql": {Data: sql},
+    })
+    assert.NotNil(err, "missing down migration not noticed")
+}
+
+func TestVerifyEmail(t *testing.T) {
+    assert := assert.New(t)
+    gin.SetMode(gin.ReleaseMode)
+    router := GetRouter()
+    mr, mock := useTestStores(t)
+
+    // verifying gives the logged in user a fresh session
+    token, err := createVerifyToken(3, "ada@example.com")
+    assert.Nil(err)
+    cookie := testSession(t, 3)
+    mock.ExpectExec("SET email_verified=TRUE").
+        WithArgs(3, "ada@example.com").WillReturnResult(sqlmock.NewResult(0, 1))
+    resp := testRequest(router, "POST", "/user/verify",
+                        url.Values{"token": {token}}, cookie)
+    assert.Equal(200, resp.Code, "response code not as expected")
+    assert.False(mr.Exists("session:" + sessionTokenHash(cookie.Value)))
+    fresh := findCookie(resp, SessionCookieName)
+    assert.NotNil(fresh)
+    assert.True(mr.Exists("session:" + sessionTokenHash(fresh.Value)))
+
+    // tokens only work once
+    resp = testRequest(router, "POST", "/user/verify",
+                       url.Values{"token": {token}})
+    assert.Equal(400, resp.Code, "response code not as expected")
+
+    // nor for an address changed since the link was sent
+    token, _ = createVerifyToken(3, "old@example.com")
+    mock.ExpectExec("SET email_verified=TRUE").
+        WithArgs(3, "old@example.com").WillReturnResult(sqlmock.NewResult(0, 0))
+    resp = testRequest(router, "POST", "/user/verify",
+                       url.Values{"token": {token}})
+    assert.Equal(400, resp.Code, "response code not as expected")
+    assert.Nil(mock.ExpectationsWereMet())
+}
+
+func TestResendVerification(t *testing.T) {
+    assert := assert.New(t)
+    gin.SetMode(gin.ReleaseMode)
+    router := GetRouter()
+    _, mock := useTestStores(t)
+    mailPath := useTestMailer(t)
+    cookie := testSession(t, 3)
+    columns := []string{"email", "email_verified"}
+
+    // a new link is sent
+    mock.ExpectQuery("SELECT email, email_verified").WithArgs(3).
+        WillReturnRows(sqlmock.NewRows(columns).AddRow("ada@example.com", false))
+    resp := testRequest(router, "POST", "/user/verify/resend", nil, cookie)
+    assert.Equal(200, resp.Code, "response code not as expected")
+    raw, _ := os.ReadFile(mailPath)
+    assert.Contains(string(raw), "To: ada@example.com\r\n")
+    assert.Contains(string(raw), "/?verify=")
+
+    // but not again straight away
+    mock.ExpectQuery("SELECT email, email_verified").WithArgs(3).
+        WillReturnRows(sqlmock.NewRows(columns).AddRow("ada@example.com", false))
+    resp = testRequest(router, "POST", "/user/verify/resend", nil, cookie)
+    assert.Equal(429, resp.Code, "response code not as expected")
+    assert.NotEmpty(resp.Header().Get("Retry-After"))
+
+    // nor once verified
+    mock.ExpectQuery("SELECT email, email_verified").WithArgs(3).
+        WillReturnRows(sqlmock.NewRows(columns).AddRow("ada@example.com", true))
+    resp = testRequest(router, "POST", "/user/verify/resend", nil, cookie)
+    assert.Equal(400, resp.Code, "response code not as expected")
+    assert.Nil(mock.ExpectationsWereMet())
+}
+
+func TestRequireVerified(t *testing.T) {
+    assert := assert.New(t)
+    gin.SetMode(gin.ReleaseMode)
+    _, mock := useTestStores(t)
+    router := gin.New()
+    router.GET("/verified", RequireVerified, func(c *gin.Context) {
+        c.Status(204)
+    })
+    cookie := testSession(t, 3)
+
+    resp := testRequest(router, "GET", "/verified", nil)
+    assert.Equal(401, resp.Code, "response code not as expected")
+
+    mock.ExpectQuery("SELECT email_verified").WithArgs(3).
+        WillReturnRows(sqlmock.NewRows([]string{"email_verified"}).AddRow(false))
+    resp = testRequest(router, "GET", "/verified", nil, cookie)
+    assert.Equal(403, resp.Code, "response code not as expected")
+
+    mock.ExpectQuery("SELECT email_verified").WithArgs(3).
+        WillReturnRows(sqlmock.NewRows([]string{"email_verified"}).AddRow(true))
+    resp = testRequest(router, "GET", "/verified", nil, cookie)
+    assert.Equal(204, resp.Code, "response code not as expected")
+    assert.Nil(mock.ExpectationsWereMet())
+}
+
+func TestRateLimit(t *testing.T) {
+    assert := assert.New(t)
+    gin.SetMode(gin.ReleaseMode)
+    useTestStores(t)
+    router := gin.New()
+    router.POST("/limited", RateLimit("test", 2, time.Minute, byClientIP),
+                func(c *gin.Context) { c.Status(204) })
+
+    resp := testRequest(router, "POST", "/limited", nil)
+    assert.Equal(204, resp.Code, "response code not as expected")
+    resp = testRequest(router, "POST", "/limited", nil)
+    assert.Equal(204, resp.Code, "response code not as expected")
+    resp = testRequest(router, "POST", "/limited", nil)
+    assert.Equal(429, resp.Code, "response code not as expected")
+    assert.Equal("60", resp.Header().Get("Retry-After"))
+
+    // forwarded addresses from untrusted clients don't get a fresh limit
+    router.SetTrustedProxies(nil)
+    for _, forwarded := range []string{"198.51.100.7", "198.51.100.8",
+                                       "198.51.100.9"} {
+        req := httptest.NewRequest("POST", "/limited", nil)
+        req.RemoteAddr = "203.0.113.1:1234"
+        req.Header.Set("X-Forwarded-For", forwarded)
+        resp = httptest.NewRecorder()
+        router.ServeHTTP(resp, req)
+    }
+    assert.Equal(429, resp.Code, "response code not as expected")
+}
+
+func TestRateLimitWait(t *testing.T) {
+    assert := assert.New(t)
+    mr, _ := useTestStores(t)
+
+    // two requests 50 and 20 seconds ago fill a limit of two a minute, the
+    // next is allowed once the one from 50 seconds ago has left the window
+    // along with the one made now
+    now := time.Now()
+    key := "ratelimit:test:wait"
+    mr.ZAdd(key, float64(now.Add(-50 * time.Second).UnixNano()), "a")
+    mr.ZAdd(key, float64(now.Add(-20 * time.Second).UnixNano()), "b")
+    wait, err := rateLimitWait(key, 2, time.Minute)
+    assert.Nil(err)
+    assert.InDelta(float64(40 * time.Second), float64(wait),
+                   float64(time.Second))
+    assert.Equal("40", retryAfter(wait))
+
+    // under the limit there is no wait
+    wait, err = rateLimitWait("ratelimit:test:other", 2, time.Minute)
+    assert.Nil(err)
+    assert.Equal(time.Duration(0), wait)
+}
+
+func TestLoginLockout(t *testing.T) {
+    assert := assert.New(t)
+    gin.SetMode(gin.ReleaseMode)
+    useTestStores(t)
+
+    // lockouts double from the threshold up to a maximum
+    assert.Equal(time.Duration(0), lockoutDuration(LockoutThreshold - 1))
+    assert.Equal(LockoutBase, lockoutDuration(LockoutThreshold))
+    assert.Equal(LockoutBase * 4, lockoutDuration(LockoutThreshold + 2))
+    assert.Equal(LockoutMax, lockoutDuration(LockoutThreshold + 100))
+
+    router := gin.New()
+    router.POST("/login", LoginLockout, func(c *gin.Context) { c.Status(204) })
+    form := url.Values{"email": {"Ada@Example.com "}}
+    for i := 0; i < LockoutThreshold - 1; i++ {
+        recordLoginFailure("ada@example.com")
+    }
+    resp := testRequest(router, "POST", "/login", form)
+    assert.Equal(204, resp.Code, "response code not as expected")
+
+    // addresses are counted regardless of case and spacing
+    recordLoginFailure("ADA@example.com")
+    resp = testRequest(router, "POST", "/login", form)
+    assert.Equal(429, resp.Code, "response code not as expected")
+    assert.Equal("60", resp.Header().Get("Retry-After"))
+
+    // a successful login doesn't lift a lockout already in place, but
+    // starts the count again
+    clearLoginFailures("ada@example.com")
+    resp = testRequest(router, "POST", "/login", form)
+    assert.Equal(429, resp.Code, "response code not as expected")
+}
+
+func TestUpdateProfile(t *testing.T) {
+    assert := assert.New(t)
+    gin.SetMode(gin.ReleaseMode)
+    router := GetRouter()
+    _, mock := useTestStores(t)
+    mailPath := useTestMailer(t)
+    cookie := testSession(t, 3)
+    hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+    columns := []string{"first_name", "last_name", "email", "display_name",
+                        "show_real_name"}
+    row := func() *sqlmock.Rows {
+        return sqlmock.NewRows(columns).AddRow("Ada", "Lovelace",
+                                              "ada@example.com", nil, false)
+    }
+
+    resp := testRequest(router, "PATCH", "/user/profile",
+                        url.Values{"first_name": {"Augusta"}})
+    assert.Equal(401, resp.Code, "response code not as expected")
+
+    // fields not given are left as they were
+    mock.ExpectQuery("SELECT first_name").WithArgs(3).WillReturnRows(row())
+    mock.ExpectExec("UPDATE webapp.user").
+        WithArgs("Augusta", "Lovelace", "ada@example.com",
+                 sql.NullString{}, true, 3).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    resp = testRequest(router, "PATCH", "/user/profile",
+                       url.Values{"first_name": {"Augusta"},
+                                  "show_real_name": {"true"}}, cookie)
+    assert.Equal(200, resp.Code, "response code not as expected")
+    assert.Contains(resp.Body.String(), "profile has been updated")
+
+    // changing the address needs the password
+    mock.ExpectQuery("SELECT first_name").WithArgs(3).WillReturnRows(row())
+    mock.ExpectQuery("SELECT password").WithArgs(3).
+        WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow(hash))
+    resp = testRequest(router, "PATCH", "/user/profile",
+                       url.Values{"email": {"countess@example.com"}}, cookie)
+    assert.Equal(403, resp.Code, "response code not as expected")
+
+    // a new address is sent a verification link, the old one a notice
+    mock.ExpectQuery("SELECT first_name").WithArgs(3).WillReturnRows(row())
+    mock.ExpectQuery("SELECT password").WithArgs(3).
+        WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow(hash))
+    mock.ExpectExec("UPDATE webapp.user").
+        WithArgs("Ada", "Lovelace", "countess@example.com",
+                 sql.NullString{}, false, 3).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    resp = testRequest(router, "PATCH", "/user/profile",
+                       url.Values{"email": {"countess@example.com"},
+                                  "current_password": {"secret"}}, cookie)
+    assert.Equal(200, resp.Code, "response code not as expected")
+    assert.Contains(resp.Body.String(), "verify your new email address")
+    raw, _ := os.ReadFile(mailPath)
+    assert.Contains(string(raw), "To: ada@example.com\r\n")
+    assert.Contains(string(raw), "changed to countess@example.com")
+    assert.Contains(string(raw), "To: countess@example.com\r\n")
+
+    // unless someone else has it
+    mock.ExpectQuery("SELECT first_name").WithArgs(3).WillReturnRows(row())
+    mock.ExpectQuery("SELECT password").WithArgs(3).
+        WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow(hash))
+    mock.ExpectExec("UPDATE webapp.user").
+        WillReturnError(&pq.Error{Code: pqUniqueViolation})
+    resp = testRequest(router, "PATCH", "/user/profile",
+                       url.Values{"email": {"taken@example.com"},
+                                  "current_password": {"secret"}}, cookie)
+    assert.Equal(400, resp.Code, "response code not as expected")
+    assert.Contains(resp.Body.String(), "already in use")
+
+    // invalid values are refused before anything is written
+    mock.ExpectQuery("SELECT first_name").WithArgs(3).WillReturnRows(row())
+    resp = testRequest(router, "PATCH", "/user/profile",
+                       url.Values{"email": {"not an address"}}, cookie)
+    assert.Equal(400, resp.Code, "response code not as expected")
+    assert.Nil(mock.ExpectationsWereMet())
+}
+
+func TestChangePassword(t *testing.T) {
+    assert := assert.New(t)
+    gin.SetMode(gin.ReleaseMode)
+    router := GetRouter()
+    mr, mock := useTestStores(t)
+    hash, _ := bcrypt.GenerateFromPassword([]byte("old secret"),
+                                           bcrypt.MinCost)
+    cookie := testSession(t, 3)
+    other := testSession(t, 3)
+
+    // the current password has to be right
+    mock.ExpectQuery("SELECT password").WithArgs(3).
+        WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow(hash))
+    resp := testRequest(router, "POST", "/user/password",
+                        url.Values{"current_password": {"wrong"},
+                                   "password": {"new secret"}}, cookie)
+    assert.Equal(400, resp.Code, "response code not as expected")
+
+    // changing it logs out every other session and rotates this one
+    mock.ExpectQuery("SELECT password").WithArgs(3).
+        WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow(hash))
+    mock.ExpectExec("UPDATE webapp.user SET password").
+        WithArgs(sqlmock.AnyArg(), 3).WillReturnResult(sqlmock.NewResult(0, 1))
+    resp = testRequest(router, "POST", "/user/password",
+                       url.Values{"current_password": {"old secret"},
+                                  "password": {"new secret"}}, cookie)
+    assert.Equal(200, resp.Code, "response code not as expected")
+    assert.False(mr.Exists("session:" + sessionTokenHash(cookie.Value)))
+    assert.False(mr.Exists("session:" + sessionTokenHash(other.Value)))
+
+    fresh := findCookie(resp, SessionCookieName)
+    assert.NotNil(fresh)
+    resp = testRequest(router, "GET", "/user/sessions", nil, other)
+    assert.Equal(401, resp.Code, "response code not as expected")
+    resp = testRequest(router, "GET", "/user/sessions", nil, fresh)
+    assert.Equal(200, resp.Code, "response code not as expected")
+
+    // accounts from a login provider have no password to change
+    mock.ExpectQuery("SELECT password").WithArgs(3).
+        WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow(nil))
+    resp = testRequest(router, "POST", "/user/password",
+                       url.Values{"password": {"new secret"}}, fresh)
+    assert.Equal(400, resp.Code, "response code not as expected")
+    assert.Nil(mock.ExpectationsWereMet())
+}
+
+func TestDeleteAccount(t *testing.T) {
+    assert := assert.New(t)
+    gin.SetMode(gin.ReleaseMode)
+    router := GetRouter()
+    mr, mock := useTestStores(t)
+    hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+    cookie := testSession(t, 3)
+    other := testSession(t, 3)
+    mr.Set("progress:3:zodiac", "4")
+    mr.Set("progress:4:zodiac", "2")
+    mr.ZAdd("leaderboard", 10, "3")
+    mr.ZAdd("leaderboard", 12, "4")
+    mr.Set("verify-resend:3", "1")
+    mr.Set("login-failures:ada@example.com", "2")
+    mr.Set("lockout:ada@example.com", "1")
+
+    // a session alone isn't enough
+    mock.ExpectQuery("SELECT password").WithArgs(3).
+        WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow(hash))
+    resp := testRequest(router, "DELETE", "/user", nil, cookie)
+    assert.Equal(403, resp.Code, "response code not as expected")
+
+    mock.ExpectQuery("SELECT password").WithArgs(3).
+        WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow(hash))
+    resp = testRequest(router, "DELETE", "/user",
+                       url.Values{"password": {"wrong"}}, cookie)
+    assert.Equal(403, resp.Code, "response code not as expected")
+
+    // accounts without a password need to have just logged in
+    mr.HSet("session:" + sessionTokenHash(cookie.Value), "created",
+            strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10))
+    mock.ExpectQuery("SELECT password").WithArgs(3).
+        WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow(nil))
+    resp = testRequest(router, "DELETE", "/user", nil, cookie)
+    assert.Equal(403, resp.Code, "response code not as expected")
+    assert.Contains(resp.Body.String(), "login again")
+
+    // everything about the user goes, in postgres and redis
+    mock.ExpectQuery("SELECT password").WithArgs(3).
+        WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow(hash))
+    mock.ExpectBegin()
+    for _, table := range []string{"api_token", "user_identity"} {
+        mock.ExpectExec("DELETE FROM webapp." + table + " ").WithArgs(3).
+            WillReturnResult(sqlmock.NewResult(0, 1))
+    }
+    mock.ExpectQuery("DELETE FROM webapp.user ").WithArgs(3).
+        WillReturnRows(sqlmock.NewRows([]string{"email"}).
+                       AddRow("ada@example.com"))
+    mock.ExpectCommit()
+    resp = testRequest(router, "DELETE", "/user",
+                       url.Values{"password": {"secret"}}, cookie)
+    assert.Equal(200, resp.Code, "response code not as expected")
+    assert.Nil(mock.ExpectationsWereMet())
+
+    for _, key := range []string{"session:" + sessionTokenHash(cookie.Value),
+                                 "session:" + sessionTokenHash(other.Value),
+                                 userSessionsKey(3), "progress:3:zodiac",
+                                 "verify-resend:3",
+                                 "login-failures:ada@example.com",
+                                 "lockout:ada@example.com"} {
+        assert.False(mr.Exists(key), key)
+    }
+    members, _ := mr.ZMembers("leaderboard")
+    assert.Equal([]string{"4"}, members)
+    assert.True(mr.Exists("progress:4:zodiac"))
+}
+
+func TestUserSessions(t *testing.T) {
+    assert := assert.New(t)
+    gin.SetMode(gin.ReleaseMode)
+    router := GetRouter()
+    mr, _ := useTestStores(t)
+    cookie := testSession(t, 3)
+    other := testSession(t, 3)
+    stranger := testSession(t, 4)
+
+    resp := testRequest(router, "GET", "/user/sessions", nil)
+    assert.Equal(401, resp.Code, "response code not as expected")
+
+    // only the user's own sessions are listed, marking the current one
+    resp = testRequest(router, "GET", "/user/sessions", nil, cookie)
+    assert.Equal(200, resp.Code, "response code not as expected")
+    var sessions []Session
+    assert.Nil(json.Unmarshal(resp.Body.Bytes(), &sessions))
+    assert.Len(sessions, 2)
+    ids := map[string]bool{}
+    for _, session := range sessions {
+        ids[session.Id] = session.Current
+    }
+    assert.Equal(map[string]bool{sessionTokenHash(cookie.Value): true,
+                                 sessionTokenHash(other.Value): false}, ids)
+
+    // expired sessions drop out of the list
+    mr.Del("session:" + sessionTokenHash(other.Value))
+    resp = testRequest(router, "GET", "/user/sessions", nil, cookie)
+    assert.Nil(json.Unmarshal(resp.Body.Bytes(), &sessions))
+    assert.Len(sessions, 1)
+    other = testSession(t, 3)
+
+    // another user's session can't be revoked
+    resp = testRequest(router, "DELETE", "/user/sessions/" +
+                       sessionTokenHash(stranger.Value), nil, cookie)
+    assert.Equal(404, resp.Code, "response code not as expected")
+    resp = testRequest(router, "GET", "/user/sessions", nil, stranger)
+    assert.Equal(200, resp.Code, "response code not as expected")
+
+    // a revoked session stops working, the others carry on
+    resp = testRequest(router, "DELETE", "/user/sessions/" +
+                       sessionTokenHash(other.Value), nil, cookie)
+    assert.Equal(200, resp.Code, "response code not as expected")
+    resp = testRequest(router, "GET", "/user/sessions", nil, other)
+    assert.Equal(401, resp.Code, "response code not as expected")
+    resp = testRequest(router, "GET", "/user/sessions", nil, cookie)
+    assert.Equal(200, resp.Code, "response code not as expected")
+
+    // revoking the current session logs out
+    resp = testRequest(router, "DELETE", "/user/sessions/" +
+                       sessionTokenHash(cookie.Value), nil, cookie)
+    assert.Equal(200, resp.Code, "response code not as expected")
+    assert.Equal(-1, findCookie(resp, SessionCookieName).MaxAge)
+    resp = testRequest(router, "GET", "/user/sessions", nil, cookie)
+    assert.Equal(401, resp.Code, "response code not as expected")
+
+    // revoking all logs out everywhere, with a new session for this device
+    cookie = testSession(t, 3)
+    other = testSession(t, 3)
+    resp = testRequest(router, "DELETE", "/user/sessions", nil, cookie)
+    assert.Equal(200, resp.Code, "response code not as expected")
+    fresh := findCookie(resp, SessionCookieName)
+    assert.NotNil(fresh)
+    for _, revoked := range []*http.Cookie{cookie, other} {
+        resp = testRequest(router, "GET", "/user/sessions", nil, revoked)
+        assert.Equal(401, resp.Code, "response code not as expected")
+    }
+    resp = testRequest(router, "GET", "/user/sessions", nil, fresh)
+    assert.Equal(200, resp.Code, "response code not as expected")
+    assert.Nil(json.Unmarshal(resp.Body.Bytes(), &sessions))
+    assert.Len(sessions, 1)
+
+    // other users are left logged in
+    resp = testRequest(router, "GET", "/user/sessions", nil, stranger)
+    assert.Equal(200, resp.Code, "response code not as expected")
+}
+
+func TestSessionRotation(t *testing.T) {
+    assert := assert.New(t)
+    gin.SetMode(gin.ReleaseMode)
+    router := GetRouter()
+    _, mock := useTestStores(t)
+    hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+
+    // verifying an address replaces the session it was done in
+    cookie := testSession(t, 3)
+    token, _ := createVerifyToken(3, "ada@example.com")
+    mock.ExpectExec("SET email_verified=TRUE").
+        WithArgs(3, "ada@example.com").WillReturnResult(sqlmock.NewResult(0, 1))
+    resp := testRequest(router, "POST", "/user/verify",
+                        url.Values{"token": {token}}, cookie)
+    assert.Equal(200, resp.Code, "response code not as expected")
+    fresh := findCookie(resp, SessionCookieName)
+    assert.NotNil(fresh)
+    assert.NotEqual(cookie.Value, fresh.Value)
+    resp = testRequest(router, "GET", "/user/sessions", nil, cookie)
+    assert.Equal(401, resp.Code, "response code not as expected")
+    resp = testRequest(router, "GET", "/user/sessions", nil, fresh)
+    assert.Equal(200, resp.Code, "response code not as expected")
+
+    // changing the password replaces it too, and ends every other one
+    other := testSession(t, 3)
+    mock.ExpectQuery("SELECT password").WithArgs(3).
+        WillReturnRows(sqlmock.NewRows([]string{"password"}).AddRow(hash))
+    mock.ExpectExec("UPDATE webapp.user SET password").
+        WithArgs(sqlmock.AnyArg(), 3).WillReturnResult(sqlmock.NewResult(0, 1))
+    resp = testRequest(router, "POST", "/user/password",
+                       url.Values{"current_password": {"secret"},
+                                  "password": {"new secret"}}, fresh)
+    assert.Equal(200, resp.Code, "response code not as expected")
+    rotated := findCookie(resp, SessionCookieName)
+    assert.NotNil(rotated)
+    for _, revoked := range []*http.Cookie{fresh, other} {
+        resp = testRequest(router, "GET", "/user/sessions", nil, revoked)
+        assert.Equal(401, resp.Code, "response code not as expected")
+    }
+    resp = testRequest(router, "GET", "/user/sessions", nil, rotated)
+    assert.Equal(200, resp.Code, "response code not as expected")
+    assert.Nil(mock.ExpectationsWereMet())
+}
+
+func TestLegacyLeaderboardEntries(t *testing.T) {
+    assert := assert.New(t)
+    gin.SetMode(gin.ReleaseMode)
+    router := GetRouter()
+    mr, mock := useTestStores(t)
+    mr.ZAdd("leaderboard", 30, "Ada")
+    mr.ZAdd("leaderboard", 20, "3")
+    columns := []string{"user_id", "display_name", "first_name", "last_name",
+                        "show_real_name"}
+
+    // entries kept by name are skipped, but reading leaves them alone
+    mock.ExpectQuery("SELECT user_id, display_name").
+        WillReturnRows(sqlmock.NewRows(columns).
+                       AddRow(3, "stargazer", "Ada", "Lovelace", false))
+    resp := testRequest(router, "GET", "/leaderboard", nil)
+    assert.Equal(200, resp.Code, "response code not as expected")
+    assert.Equal(`[{"name":"stargazer","score":20}]`, resp.Body.String())
+    members, _ := mr.ZMembers("leaderboard")
+    assert.ElementsMatch([]string{"Ada", "3"}, members)
+
+    // they are removed by the migrate command
+    assert.Nil(removeLegacyLeaderboardEntries())
+    members, _ = mr.ZMembers("leaderboard")
+    assert.Equal([]string{"3"}, members)
+    assert.Nil(mock.ExpectationsWereMet())
+}
+
+func TestLoginIgnoresEmailCase(t *testing.T) {
+    assert := assert.New(t)
+    gin.SetMode(gin.ReleaseMode)
+    router := GetRouter()
+    _, mock := useTestStores(t)
+    hash, _ := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+
+    // addresses are unique regardless of case, so they are looked up that way
+    mock.ExpectQuery("WHERE lower\\(email\\)=lower\\(\\$1\\)").
+        WithArgs("Ada@Example.com").
+        WillReturnRows(sqlmock.NewRows([]string{"user_id", "email", "password"}).
+                       AddRow(3, "ada@example.com", hash))
+    mock.ExpectExec("SET last_login").WithArgs(3).
+        WillReturnResult(sqlmock.NewResult(0, 1))
+    resp := testRequest(router, "POST", "/user/login",
+                        url.Values{"email": {"Ada@Example.com"},
+                                   "password": {"secret"}})
+    assert.Equal(200, resp.Code, "response code not as expected")
+    assert.NotNil(findCookie(resp, SessionCookieName))
+    assert.Nil(mock.ExpectationsWereMet())
+}
+
+func TestClassroomRateLimits(t *testing.T) {
+    assert := assert.New(t)
+    useTestStores(t)
+
+    // a whole class behind one address can register and login at once
+    limits := []struct {
+        name   string
+        limit  int
+        window time.Duration
+    }{
+        {"register", RegisterIPLimit, time.Hour},
+        {"login-ip", LoginIPLimit, time.Minute},
+        {"forgot-ip", ForgotIPLimit, time.Hour},
+    }
+    for _, l := range limits {
+        key := "ratelimit:" + l.name + ":192.0.2.1"
+        for i := 0; i < ClassroomSize; i++ {
+            wait, err := rateLimitWait(key, l.limit, l.window)
+            assert.Nil(err)
+            assert.Equal(time.Duration(0), wait, l.name)
+        }
+    }
+
+    // while a single account is still limited
+    for i := 0; i < LoginAccountLimit; i++ {
+        rateLimitWait("ratelimit:login-account:ada@example.com",
+                      LoginAccountLimit, time.Minute)
+    }
+    wait, err := rateLimitWait("ratelimit:login-account:ada@example.com",
+                               LoginAccountLimit, time.Minute)
+    assert.Nil(err)
+    assert.True(wait > 0)
+}
+
+func TestRoleCommand(t *testing.T) {
+    assert := assert.New(t)
+    mr, mock := useTestStores(t)
+    migrations := embeddedMigrations()
+    latest := migrations[len(migrations) - 1].Version
+    version := func() {
+        mock.ExpectQuery("SELECT max\\(version\\)").
+            WillReturnRows(sqlmock.NewRows([]string{"max"}).AddRow(latest))
+    }
+
+    assert.Equal(2, roleCommand([]string{"ada@example.com"}))
+    assert.Equal(2, roleCommand([]string{"ada@example.com", "wizard"}))
+
+    // the role is set and sessions from before it are ended
+    cookie := testSession(t, 3)
+    version()
+    mock.ExpectQuery("UPDATE webapp.user SET role").
+        WithArgs(RoleAdmin, "Ada@Example.com").
+        WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(3))
+    assert.Equal(0, roleCommand([]string{"Ada@Example.com", "admin"}))
+    assert.False(mr.Exists("session:" + sessionTokenHash(cookie.Value)))
+
+    version()
+    mock.ExpectQuery("UPDATE webapp.user SET role").
+        WithArgs(RoleAdmin, "nobody@example.com").
+        WillReturnError(sql.ErrNoRows)
+    assert.Equal(1, roleCommand([]string{"nobody@example.com", "admin"}))
+    assert.Nil(mock.ExpectationsWereMet())
+}
+
+func TestRegistrationMailsLater(t *testing.T) {
+    assert := assert.New(t)
+    gin.SetMode(gin.ReleaseMode)
+    router := GetRouter()
+    _, mock := useTestStores(t)
+    mailPath := useTestMailer(t)
+
+    // the verification link is sent after answering
+    mock.ExpectQuery("INSERT INTO webapp.user").
+        WillReturnRows(sqlmock.NewRows([]string{"user_id"}).AddRow(3))
+    resp := testRequest(router, "POST", "/user/register",
+                        url.Values{"first_name": {"Ada"},
+                                   "last_name": {"Lovelace"},
+                                   "email": {"ada@example.com"},
+                                   "password": {"secret"}})
+    assert.Equal(200, resp.Code, "response code not as expected")
+    assert.NotNil(findCookie(resp, SessionCookieName))
+
+    pendingMail.Wait()
+    raw, _ := os.ReadFile(mailPath)
+    assert.Contains(string(raw), "To: ada@example.com\r\n")
+    assert.Contains(string(raw), "/?verify=")
+    assert.Nil(mock.ExpectationsWereMet())
+}
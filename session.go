@@ -0,0 +1,208 @@
+package main
+
+import (
+  "encoding/base64"
+  "net/http"
+  "sort"
+  "time"
+  "github.com/gin-gonic/gin"
+  "github.com/garyburd/redigo/redis"
+)
+
+/******************************************************************************
+ * Type Declarations
+ *****************************************************************************/
+
+// a logged in device as shown to its user, identified by the session hash
+// which can't be used to log in
+type Session struct {
+    Id        string `json:"id"`
+    Current   bool   `json:"current"`
+    Created   int64  `json:"created"`
+    LastSeen  int64  `json:"lastSeen"`
+    UserAgent string `json:"userAgent"`
+    IP        string `json:"ip"`
+}
+
+/******************************************************************************
+ * Helper functions
+ *****************************************************************************/
+
+// hash of the session token sent in a cookie, empty if it isn't valid
+func sessionTokenHash(token string) string {
+    bytes, err := base64.URLEncoding.DecodeString(token)
+    if err != nil || len(bytes) != SessionTokenBytes {
+        return ""
+    }
+
+    return hashToken(bytes)
+}
+
+// record that a session was just used and push back its expiry
+func touchUserSession(con redis.Conn, userId int, sessionHash string) {
+    ttl := int(SessionMaxLength.Seconds())
+    con.Send("MULTI")
+    con.Send("HSET", "session:" + sessionHash, "seen", time.Now().Unix())
+    con.Send("EXPIRE", "session:" + sessionHash, ttl)
+    con.Send("EXPIRE", userSessionsKey(userId), ttl)
+    con.Do("EXEC")
+}
+
+// delete one session of a user
+func deleteUserSession(userId int, sessionHash string) error {
+    con := stores.redisPool.Get()
+    defer con.Close()
+
+    con.Send("MULTI")
+    con.Send("DEL", "session:" + sessionHash)
+    con.Send("SREM", userSessionsKey(userId), sessionHash)
+    _, err := con.Do("EXEC")
+    return err
+}
+
+// delete every session of a user, logging them out everywhere
+func deleteUserSessions(userId int) error {
+    con := stores.redisPool.Get()
+    defer con.Close()
+
+    hashes, err := redis.Strings(con.Do("SMEMBERS", userSessionsKey(userId)))
+    if err != nil {
+        return err
+    }
+
+    for _, sessionHash := range hashes {
+        con.Send("DEL", "session:" + sessionHash)
+    }
+    _, err = con.Do("DEL", userSessionsKey(userId))
+    return err
+}
+
+// replace the current session with a new one, done whenever the user gains
+// privileges so a session id known to someone else is worth less
+func rotateUserSession(c *gin.Context, userId int, token string) bool {
+    if sessionHash := sessionTokenHash(token); sessionHash != "" {
+        deleteUserSession(userId, sessionHash)
+    }
+
+    return createUserSession(c, userId)
+}
+
+// every live session of a user, most recently used first, forgetting those
+// which have expired
+func listUserSessions(userId int, currentHash string) ([]Session, error) {
+    con := stores.redisPool.Get()
+    defer con.Close()
+
+    hashes, err := redis.Strings(con.Do("SMEMBERS", userSessionsKey(userId)))
+    if err != nil {
+        return nil, err
+    }
+
+    sessions := []Session{}
+    for _, sessionHash := range hashes {
+        values, err := redis.Values(con.Do("HMGET", "session:" + sessionHash,
+                                           "user", "created", "seen",
+                                           "agent", "ip"))
+        if err != nil {
+            return nil, err
+        }
+
+        var owner int
+        session := Session{Id: sessionHash, Current: sessionHash == currentHash}
+        _, err = redis.Scan(values, &owner, &session.Created, &session.LastSeen,
+                            &session.UserAgent, &session.IP)
+        if err != nil || owner != userId {
+            con.Do("SREM", userSessionsKey(userId), sessionHash)
+            continue
+        }
+
+        sessions = append(sessions, session)
+    }
+
+    sort.Slice(sessions, func(i, j int) bool {
+        return sessions[i].LastSeen > sessions[j].LastSeen
+    })
+    return sessions, nil
+}
+
+/******************************************************************************
+ * Handlers
+ *****************************************************************************/
+
+func handleListSessions(c *gin.Context) {
+    // get userid of logged in user, abort if 0
+    userId, token := getLoggedInUser(c)
+    if userId <= 0 {
+        c.JSON(401, gin.H{"error": "not logged in"})
+        return
+    }
+
+    sessions, err := listUserSessions(userId, sessionTokenHash(token))
+    if err != nil {
+        c.JSON(500, gin.H{"error": "unexpected error occurred"})
+        return
+    }
+
+    c.JSON(200, sessions)
+}
+
+func handleRevokeSession(c *gin.Context) {
+    // get userid of logged in user, abort if 0
+    userId, token := getLoggedInUser(c)
+    if userId <= 0 {
+        c.JSON(401, gin.H{"error": "not logged in"})
+        return
+    }
+
+    // only sessions in the user's own index can be revoked
+    sessionHash := c.Param("session")
+    con := stores.redisPool.Get()
+    owned, err := redis.Bool(con.Do("SISMEMBER", userSessionsKey(userId),
+                                    sessionHash))
+    con.Close()
+    if err != nil {
+        c.JSON(500, gin.H{"error": "unexpected error occurred"})
+        return
+    }
+
+    if !owned {
+        c.JSON(404, gin.H{"error": "session not found"})
+        return
+    }
+
+    if err = deleteUserSession(userId, sessionHash); err != nil {
+        c.JSON(500, gin.H{"error": "unexpected error occurred"})
+        return
+    }
+
+    // revoking the current session is logging out
+    if sessionHash == sessionTokenHash(token) {
+        http.SetCookie(c.Writer, createSessionCookie("", -1))
+    }
+
+    c.JSON(200, gin.H{"message": "session has been revoked"})
+}
+
+func handleRevokeSessions(c *gin.Context) {
+    // get userid of logged in user, abort if 0
+    userId, token := getLoggedInUser(c)
+    if userId <= 0 {
+        c.JSON(401, gin.H{"error": "not logged in"})
+        return
+    }
+
+    // log out everywhere, then log this device back in with a new session
+    if err := deleteUserSessions(userId); err != nil {
+        c.JSON(500, gin.H{"error": "unexpected error occurred"})
+        return
+    }
+
+    if !rotateUserSession(c, userId, token) {
+        http.SetCookie(c.Writer, createSessionCookie("", -1))
+        c.JSON(200, gin.H{"message": "all sessions have been revoked, " +
+                                     "please login"})
+        return
+    }
+
+    c.JSON(200, gin.H{"message": "all other sessions have been revoked"})
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+  "bytes"
+  "encoding/gob"
+  "log"
+  "net/http"
+  "strings"
+  "sync"
+  "time"
+  "github.com/garyburd/redigo/redis"
+)
+
+/******************************************************************************
+ * Constants
+ *****************************************************************************/
+
+const (
+    SharedCachePrefix    string        = "cache:"
+    SharedCacheChannel   string        = "cache:invalidate"
+    SharedCacheRetry     time.Duration = 5 * time.Second
+    sharedCacheScanCount int           = 500
+)
+
+/******************************************************************************
+ * Type Declarations
+ *****************************************************************************/
+
+// serialisable form of responseData
+type sharedResponse struct {
+    Status   int
+    Header   http.Header
+    Data     []byte
+    Variants map[string][]byte
+}
+
+// response cache tier in redis shared by every instance, invalidations are
+// broadcast so each instance can drop its own in-memory copies
+type SharedCache struct {
+    pool    *redis.Pool
+    once    sync.Once
+    version string
+}
+
+/******************************************************************************
+ * Helper functions
+ *****************************************************************************/
+
+// entries are only shared between instances serving the same catalog and
+// assets, so must be created once the site is loaded
+func NewSharedCache(pool *redis.Pool) *SharedCache {
+    return &SharedCache{pool: pool,
+                        version: catalogVersion + "-" + assetVersion}
+}
+
+// redis key of a cached response, versioned so that instances of different
+// builds never serve each other's responses during a rolling deploy, the path
+// follows so that entries can be matched by path prefix
+func sharedCacheKey(version string, path string, key string) string {
+    return SharedCachePrefix + version + ":" + path + " " + key
+}
+
+// escape glob characters so prefix is matched literally by SCAN
+func escapeGlob(prefix string) string {
+    replacer := strings.NewReplacer("\\", "\\\\", "*", "\\*", "?", "\\?",
+                                    "[", "\\[", "]", "\\]")
+    return replacer.Replace(prefix)
+}
+
+func encodeResponse(response *responseData) ([]byte, error) {
+    var buffer bytes.Buffer
+    shared := sharedResponse{response.status, response.header,
+                             response.data, response.variants}
+    err := gob.NewEncoder(&buffer).Encode(&shared)
+    return buffer.Bytes(), err
+}
+
+func decodeResponse(raw []byte) (*responseData, error) {
+    var shared sharedResponse
+    if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&shared); err != nil {
+        return nil, err
+    }
+
+    return &responseData{shared.Status, shared.Header,
+                         shared.Data, shared.Variants}, nil
+}
+
+/******************************************************************************
+ * Shared store
+ *****************************************************************************/
+
+// returns the response cached under key and how long it has left to live,
+// any redis error is treated as a miss so we fall back to memory
+func (store *SharedCache) Get(path string,
+                              key string) (*responseData, time.Duration, bool) {
+    if store == nil {
+        return nil, 0, false
+    }
+
+    con := store.pool.Get()
+    defer con.Close()
+
+    redisKey := sharedCacheKey(store.version, path, key)
+    con.Send("MULTI")
+    con.Send("GET", redisKey)
+    con.Send("PTTL", redisKey)
+    r, err := redis.Values(con.Do("EXEC"))
+    if err != nil || len(r) != 2 || r[0] == nil {
+        return nil, 0, false
+    }
+
+    raw, err := redis.Bytes(r[0], nil)
+    ttl, _ := redis.Int64(r[1], nil)
+    if err != nil || ttl <= 0 {
+        return nil, 0, false
+    }
+
+    response, err := decodeResponse(raw)
+    if err != nil {
+        return nil, 0, false
+    }
+
+    return response, time.Duration(ttl) * time.Millisecond, true
+}
+
+// cache response under key for ttl
+func (store *SharedCache) Set(path string, key string,
+                              response *responseData, ttl time.Duration) {
+    if store == nil {
+        return
+    }
+
+    raw, err := encodeResponse(response)
+    if err != nil {
+        return
+    }
+
+    con := store.pool.Get()
+    defer con.Close()
+
+    milliseconds := int64(ttl / time.Millisecond)
+    con.Do("SET", sharedCacheKey(store.version, path, key), raw,
+           "PX", milliseconds)
+}
+
+// delete shared entries for paths starting with prefix and tell every
+// instance to drop them from memory
+func (store *SharedCache) Invalidate(prefix string) {
+    if store == nil {
+        return
+    }
+
+    con := store.pool.Get()
+    defer con.Close()
+
+    // walk matching keys of every version without blocking redis, data
+    // changes make the responses of older builds stale too
+    match := escapeGlob(SharedCachePrefix) + "*:" + escapeGlob(prefix) + "*"
+    cursor := 0
+    for {
+        r, err := redis.Values(con.Do("SCAN", cursor, "MATCH", match,
+                                      "COUNT", sharedCacheScanCount))
+        if err != nil || len(r) != 2 {
+            break
+        }
+
+        cursor, _ = redis.Int(r[0], nil)
+        keys, _ := redis.Strings(r[1], nil)
+        for _, key := range keys {
+            con.Do("DEL", key)
+        }
+
+        if cursor == 0 {
+            break
+        }
+    }
+
+    con.Do("PUBLISH", SharedCacheChannel, prefix)
+}
+
+// listen for invalidations from other instances until the process exits,
+// reconnecting whenever redis goes away
+func (store *SharedCache) subscribe() {
+    lost := false
+    for {
+        con := redis.PubSubConn{Conn: store.pool.Get()}
+        err := con.Subscribe(SharedCacheChannel)
+        for err == nil {
+            switch message := con.Receive().(type) {
+            case redis.Subscription:
+                // invalidations may have been missed while disconnected, drop
+                // everything once they can't be missed any more
+                if lost {
+                    stores.responseStore.Invalidate("/")
+                    log.Println("shared cache subscription restored")
+                    lost = false
+                }
+            case redis.Message:
+                stores.responseStore.Invalidate(string(message.Data))
+            case error:
+                err = message
+            }
+        }
+
+        // keep serving from memory meanwhile, only logging the first failure
+        // as every retry fails the same way until redis is back
+        con.Close()
+        if !lost {
+            log.Println("shared cache subscription lost, retrying:", err)
+            lost = true
+        }
+        time.Sleep(SharedCacheRetry)
+    }
+}
+
+// start listening for invalidations and forward our own to redis, safe to
+// call more than once
+func (store *SharedCache) Start() {
+    if store == nil {
+        return
+    }
+
+    store.once.Do(func() {
+        onCacheInvalidate(store.Invalidate)
+        go store.subscribe()
+    })
+}
@@ -1,22 +1,39 @@
 package main
 
 import (
+    "crypto/sha256"
+    "encoding/hex"
     "encoding/json"
-    "io/ioutil"
+    "hash"
+    "io/fs"
     "log"
     "math/rand"
+    "path"
+    "strings"
 )
 
 const (
-    constellationPath string = "data/constellations.json"
+    culturesPath      string = "data/cultures.json"
+    constellationFile string = "constellations.json"
+    familiesFile      string = "families.json"
+    asterismFile      string = "asterisms.json"
     starPath          string = "data/stars.json"
-    familiesPath      string = "data/families.json"
+    DefaultCulture    string = "western"
+    CatalogVersionLen int    = 16
 )
 
 var (
-    families       []Family          = make([]Family, 0)
-    familySize     map[string]uint64 = make(map[string]uint64)
-    constellations []Constellation   = make([]Constellation, 0)
+    // sky cultures in the order they are listed, and indexed by id
+    skyCultures    []*SkyCulture          = make([]*SkyCulture, 0)
+    skyCultureById map[string]*SkyCulture = make(map[string]*SkyCulture)
+    defaultCulture *SkyCulture
+
+    // stars are shared by every culture, indexed by hipparcos id
+    starIndex map[uint64]Star = make(map[uint64]Star)
+
+    // content hash of every catalog file read, identifies the catalog version
+    catalogHash    hash.Hash = sha256.New()
+    catalogVersion string
 )
 
 type Star struct {
@@ -46,9 +63,17 @@ type Constellation struct {
     Edges   []Edge  `json:"edges"`
 }
 
+type Asterism struct {
+    Name           string   `json:"name"`
+    Info           string   `json:"info"`
+    Constellations []string `json:"constellations"`
+    Edges          []Edge   `json:"edges"`
+}
+
 type Group struct {
     Level             uint64   `json:"level"`
     Constellations    []string `json:"constellations"`
+    Asterisms         []string `json:"asterisms,omitempty"`
 }
 
 type Family struct {
@@ -58,31 +83,177 @@ type Family struct {
     Groups            []Group `json:"groups"`
 }
 
-func init() {
-    raw, err := ioutil.ReadFile(familiesPath)
+type SkyCulture struct {
+    Id             string          `json:"id"`
+    Name           string          `json:"name"`
+    Info           string          `json:"info"`
+    Families       []Family        `json:"-"`
+    Constellations []Constellation `json:"-"`
+    Asterisms      []Asterism      `json:"-"`
+
+    // lookup tables built once the culture has been read
+    familySize           map[string]uint64
+    familyConstellations map[string][]string
+    constellationFamily  map[string]string
+    groupLevel           map[string]uint64
+    constellationIndex   map[string]int
+    neighbourGraph       map[string][]string
+}
+
+type ConstellationDetail struct {
+    Constellation
+    Level      uint64   `json:"level"`
+    Stars      []Star   `json:"stars"`
+    Brightest  *Star    `json:"brightest"`
+    Neighbours []string `json:"neighbours"`
+}
+
+// read the star catalog and every sky culture from the site files
+func loadCatalog() {
+    raw, err := readCatalogFile(starPath)
     if err != nil {
-      log.Fatal("Failed to read families file.")
+      log.Fatal("Failed to read stars file.")
+    }
+
+    // index stars by hipparcos id for constellation lookups
+    stars := make([]Star, 0)
+    json.Unmarshal(raw, &stars)
+    for _, star := range stars {
+        starIndex[star.Hid] = star
+    }
+
+    raw, err = readCatalogFile(culturesPath)
+    if err != nil {
+      log.Fatal("Failed to read cultures file.")
+    }
+
+    // unmarshal list of cultures and the directory holding each one
+    manifest := make([]struct {
+        Id   string `json:"id"`
+        Name string `json:"name"`
+        Info string `json:"info"`
+        Path string `json:"path"`
+    }, 0)
+    json.Unmarshal(raw, &manifest)
+
+    for _, entry := range manifest {
+        culture := loadSkyCulture(entry.Path)
+        culture.Id = entry.Id
+        culture.Name = entry.Name
+        culture.Info = entry.Info
+
+        skyCultures = append(skyCultures, culture)
+        skyCultureById[culture.Id] = culture
+    }
+
+    defaultCulture = skyCultureById[DefaultCulture]
+    if defaultCulture == nil {
+      log.Fatal("Default sky culture " + DefaultCulture + " is missing.")
+    }
+
+    // version is derived from the contents of all files loaded
+    sum := hex.EncodeToString(catalogHash.Sum(nil))
+    catalogVersion = sum[:CatalogVersionLen]
+}
+
+// read a catalog file and add its name and contents to the catalog hash
+func readCatalogFile(name string) ([]byte, error) {
+    raw, err := fs.ReadFile(siteFiles, name)
+    if err != nil {
+        return nil, err
+    }
+
+    catalogHash.Write([]byte(name))
+    catalogHash.Write(raw)
+    return raw, nil
+}
+
+// read the families, constellations and asterisms of a sky culture from dir
+func loadSkyCulture(dir string) *SkyCulture {
+    culture := SkyCulture{
+        Families:             make([]Family, 0),
+        Constellations:       make([]Constellation, 0),
+        Asterisms:            make([]Asterism, 0),
+        familySize:           make(map[string]uint64),
+        familyConstellations: make(map[string][]string),
+        constellationFamily:  make(map[string]string),
+        groupLevel:           make(map[string]uint64),
+        constellationIndex:   make(map[string]int),
+        neighbourGraph:       make(map[string][]string),
+    }
+
+    raw, err := readCatalogFile(path.Join(dir, familiesFile))
+    if err != nil {
+      log.Fatal("Failed to read families file in " + dir + ".")
     }
 
     // unmarshal file
-    json.Unmarshal(raw, &families)
+    json.Unmarshal(raw, &culture.Families)
+
+    // populate family size, membership and group level maps, constellations
+    // of a family are kept in the order they are learned
+    for _, family := range culture.Families {
+        culture.familySize[family.Name] = family.NumConstellations
+        for _, group := range family.Groups {
+            for _, name := range group.Constellations {
+                culture.familyConstellations[family.Name] =
+                    append(culture.familyConstellations[family.Name], name)
+                culture.constellationFamily[name] = family.Name
+                culture.groupLevel[name] = group.Level
+            }
+        }
+    }
+
+    raw, err = readCatalogFile(path.Join(dir, constellationFile))
+    if err != nil {
+      log.Fatal("Failed to read constellations file in " + dir + ".")
+    }
+
+    // unmarshal
+    json.Unmarshal(raw, &culture.Constellations)
 
-    // populate family size map
-    for _, family := range families {
-        familySize[family.Name] = family.NumConstellations
+    // index constellations by lower case abbreviation
+    for i, constellation := range culture.Constellations {
+        culture.constellationIndex[strings.ToLower(constellation.Short)] = i
     }
 
-    raw, err = ioutil.ReadFile(constellationPath)
+    raw, err = readCatalogFile(path.Join(dir, asterismFile))
     if err != nil {
-      log.Fatal("Failed to read constellations file.")
+      log.Fatal("Failed to read asterisms file in " + dir + ".")
     }
 
     // unmarshal
-    json.Unmarshal(raw, &constellations)
+    json.Unmarshal(raw, &culture.Asterisms)
+
+    // families may only reference asterisms that exist
+    for _, family := range culture.Families {
+        for _, group := range family.Groups {
+            for _, name := range group.Asterisms {
+                if _, found := culture.getAsterism(name); !found {
+                    log.Fatal("Family " + family.Name +
+                              " references unknown asterism " + name + ".")
+                }
+            }
+        }
+    }
+
+    // link each constellation to those surrounding it
+    culture.buildNeighbourGraph()
+    return &culture
+}
+
+// returns the sky culture with the given id, or the default if id is empty
+func getSkyCulture(id string) (*SkyCulture, bool) {
+    if id == "" {
+        return defaultCulture, true
+    }
+
+    culture, found := skyCultureById[strings.ToLower(id)]
+    return culture, found
 }
 
 func getStars() ([]Star, error) {
-    raw, err := ioutil.ReadFile(starPath)
+    raw, err := fs.ReadFile(siteFiles, starPath)
     if err != nil {
       return []Star{}, err
     }
@@ -92,14 +263,69 @@ func getStars() ([]Star, error) {
     return stars, err
 }
 
-func getRandomConstellations(num int) []Constellation {
+func (culture *SkyCulture) getRandomConstellations(num int) []Constellation {
     questions := make([]Constellation, 0)
-    length    := len(constellations)
+    length    := len(culture.Constellations)
 
     for i := 0; i < num; i++ {
-        randomConstellation := constellations[rand.Intn(length)]
+        randomConstellation := culture.Constellations[rand.Intn(length)]
         questions = append(questions, randomConstellation)
     }
     
     return questions
 }
+
+// returns the constellation with the given abbreviation, case insensitive
+func (culture *SkyCulture) getConstellation(short string) (Constellation, bool) {
+    i, ok := culture.constellationIndex[strings.ToLower(short)]
+    if !ok {
+        return Constellation{}, false
+    }
+
+    return culture.Constellations[i], true
+}
+
+// returns the asterism with the given name, case insensitive
+func (culture *SkyCulture) getAsterism(name string) (Asterism, bool) {
+    for _, asterism := range culture.Asterisms {
+        if strings.EqualFold(asterism.Name, name) {
+            return asterism, true
+        }
+    }
+
+    return Asterism{}, false
+}
+
+// resolve the member stars, level and neighbours of a constellation
+func (culture *SkyCulture) getConstellationDetail(
+    constellation Constellation) ConstellationDetail {
+    detail := ConstellationDetail{
+        Constellation: constellation,
+        Level:         culture.groupLevel[constellation.Name],
+        Stars:         make([]Star, 0),
+        Neighbours:    culture.neighbourGraph[constellation.Short],
+    }
+
+    // collect each star referenced by an edge exactly once
+    seen := make(map[uint64]bool)
+    for _, edge := range constellation.Edges {
+        for _, hid := range []uint64{edge.Start, edge.End} {
+            star, ok := starIndex[hid]
+            if !ok || seen[hid] {
+                continue
+            }
+
+            seen[hid] = true
+            detail.Stars = append(detail.Stars, star)
+        }
+    }
+
+    // lowest magnitude is the brightest star
+    for i, star := range detail.Stars {
+        if detail.Brightest == nil || star.Mag < detail.Brightest.Mag {
+            detail.Brightest = &detail.Stars[i]
+        }
+    }
+
+    return detail
+}
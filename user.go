@@ -1,6 +1,7 @@
 package main
 
 import (
+  "database/sql"
   "time"
   "strconv"
   "net/http"
@@ -8,6 +9,7 @@ import (
   "crypto/sha256"
   "encoding/base64"
   "regexp"
+  "log"
   "github.com/gin-gonic/gin"
   "github.com/garyburd/redigo/redis"
   "golang.org/x/crypto/bcrypt"
@@ -18,29 +20,29 @@ import (
  *****************************************************************************/
 
 const (
-    SessionCookieName string        = "FIRMAMENT_SESSION"
-    SessionMaxLength  time.Duration = time.Hour * 24
-    SessionTokenBytes int           = 32
-    EmailAddrRegex    string        = ".+\\@(?:[^\\.]+\\.)+[^\\.]+"
-    BcryptCostFactor  int           = 12
+    SessionCookieName    string        = "FIRMAMENT_SESSION"
+    SessionMaxLength     time.Duration = time.Hour * 24
+    SessionTouchInterval time.Duration = time.Minute
+    SessionTokenBytes    int           = 32
+    SessionAgentLength   int           = 256
+    EmailAddrRegex       string        = ".+\\@(?:[^\\.]+\\.)+[^\\.]+"
+    BcryptCostFactor     int           = 12
 )
 
 /******************************************************************************
  * Type Declarations
  *****************************************************************************/
 
-type FamilyProgress struct {
-    Name      string `json:"name"`
-    Completed uint64 `json:"completed"`
-    Total     uint64 `json:"total"`
-}
-
 type Profile struct {
-    LoggedIn  bool             `json:"loggedIn"`
-    FirstName string           `json:"firstName"`
-    LastName  string           `json:"lastName"`
-    Email     string           `json:"email"`
-    Progress  []FamilyProgress `json:"progress"`
+    LoggedIn      bool             `json:"loggedIn"`
+    FirstName     string           `json:"firstName"`
+    LastName      string           `json:"lastName"`
+    Email         string           `json:"email"`
+    EmailVerified bool             `json:"emailVerified"`
+    DisplayName   string           `json:"displayName"`
+    ShowRealName  bool             `json:"showRealName"`
+    Role          string           `json:"role"`
+    Progress      []FamilyProgress `json:"progress"`
 }
 
 /******************************************************************************
@@ -59,8 +61,25 @@ func generateRandomId(bytes int) ([]byte, error) {
     return b, nil
 }
 
+// sha256 hash of a random token for storage and lookup, base64 encoded (no
+// need for bcrypt here as tokens are long and random)
+func hashToken(bytes []byte) string {
+    shaSum := sha256.Sum256(bytes)
+    return base64.URLEncoding.EncodeToString(shaSum[:])
+}
+
+// key of the set holding the hashes of every session of a user
+func userSessionsKey(userId int) string {
+    return "sessions:" + strconv.Itoa(userId)
+}
+
 // return the userid and session token of the logged in user, 0 otherwise.
 func getLoggedInUser(c *gin.Context) (int, string) {
+    // api tokens are only accepted by routes which name a scope
+    if token := getBearerToken(c); token != "" {
+        return getApiTokenUser(token, c.GetString(tokenScopeKey)), ""
+    }
+
     // get cookie
     val, err := c.Request.Cookie(SessionCookieName)
     if err != nil {
@@ -71,25 +90,42 @@ func getLoggedInUser(c *gin.Context) (int, string) {
     con := stores.redisPool.Get()
     defer con.Close()
 
-    // base64 decode session id
-    bytes, err := base64.URLEncoding.DecodeString(val.Value)
-    if err != nil {
+    // sha256 hash of session id for lookup
+    sessionHash := sessionTokenHash(val.Value)
+    if sessionHash == "" {
         return 0, ""
     }
 
-    // sha256 hash of session id for lookup
-    shaSum := sha256.Sum256(bytes)
-    sessionHash := base64.URLEncoding.EncodeToString(shaSum[:])
-
-    userId, err := redis.Int(con.Do("GET", "session:" + sessionHash))
+    values, err := redis.Values(con.Do("HMGET", "session:" + sessionHash,
+                                       "user", "seen"))
     if err != nil {
         return 0, val.Value
     }
 
+    var userId int
+    var seen int64
+    if _, err = redis.Scan(values, &userId, &seen); err != nil || userId <= 0 {
+        return 0, val.Value
+    }
+
+    // sessions in use are kept alive, but only written to now and again
+    if time.Since(time.Unix(seen, 0)) >= SessionTouchInterval {
+        touchUserSession(con, userId, sessionHash)
+    }
+
     // return the logged in userid
     return userId, val.Value
 }
 
+// note when a user last logged in, failing to is only logged
+func recordLogin(userId int) {
+    _, err := stores.sqlPool.Exec(
+        "UPDATE webapp.user SET last_login=NOW() WHERE user_id=$1", userId)
+    if err != nil {
+        log.Println("failed to record login:", err)
+    }
+}
+
 // create a new session for the user and set the session cookie on the response
 func createUserSession(c *gin.Context, userId int) bool {
     // get a new session id
@@ -106,16 +142,32 @@ func createUserSession(c *gin.Context, userId int) bool {
     ttl := int(SessionMaxLength.Seconds())
 
     // hash session id for storage (sha256 - no need for bcrypt here)
-    shaSum := sha256.Sum256(bytes)
-    sessionHash := base64.URLEncoding.EncodeToString(shaSum[:])
+    sessionHash := hashToken(bytes)
+    key := "session:" + sessionHash
+
+    // describe the device so the user can tell their sessions apart
+    agent := c.Request.UserAgent()
+    if len(agent) > SessionAgentLength {
+        agent = agent[:SessionAgentLength]
+    }
+    now := time.Now().Unix()
 
-    // set session token to user id
+    // set session token to user id, and add it to the user's sessions
     con.Send("MULTI")
-    con.Send("SETNX", "session:" + sessionHash, userId)
-    con.Send("EXPIRE", "session:" + sessionHash, ttl)
-    r, err := redis.Ints(con.Do("EXEC"))
-    if err != nil || r[0] == 0 || r[1] == 0 {
-        con.Do("DEL", "session:" + sessionHash)
+    con.Send("HSETNX", key, "user", userId)
+    con.Send("HMSET", key, "created", now, "seen", now,
+                           "agent", agent, "ip", c.ClientIP())
+    con.Send("EXPIRE", key, ttl)
+    con.Send("SADD", userSessionsKey(userId), sessionHash)
+    con.Send("EXPIRE", userSessionsKey(userId), ttl)
+    r, err := redis.Values(con.Do("EXEC"))
+    if err != nil || len(r) != 5 {
+        con.Do("DEL", key)
+        return false
+    }
+
+    if created, _ := redis.Int(r[0], nil); created == 0 {
+        con.Do("DEL", key)
         return false
     }
 
@@ -136,66 +188,10 @@ func createSessionCookie(token string, maxAge int) *http.Cookie {
     cookie.MaxAge = maxAge
     cookie.Secure = true
     cookie.HttpOnly = true
+    cookie.SameSite = http.SameSiteLaxMode
     return &cookie
 }
 
-// updates the progress for named family
-func setUserProgress(userId int, familyName string, newVal uint64) (bool, error) {
-    con := stores.redisPool.Get()
-    defer con.Close()
-   
-    // check if familyName is valid
-    if max, ok := familySize[familyName]; newVal < 0 || newVal > max || !ok {
-        return false, nil
-    }
-
-    // set new value
-    key := "progress:" + strconv.Itoa(userId) + ":" + familyName
-    _, err := con.Do("SET", key, newVal)
-    if err != nil {
-        return true, err
-    }
-
-    return true, nil
-}
-
-// return FamilyProgress containing user progress for named family
-func getUserProgress(userId int, familyName string) (FamilyProgress, error) {
-    con := stores.redisPool.Get()
-    defer con.Close()
-    
-    key := "progress:" + strconv.Itoa(userId) + ":" + familyName
-    exists, err := redis.Int(con.Do("EXISTS", key))
-    if err != nil {
-        return FamilyProgress{}, err
-    }
-
-    var value uint64 = 0
-    if exists == 1 {
-        value, err = redis.Uint64(con.Do("GET", key))
-        if err != nil {
-            return FamilyProgress{}, err
-        }
-    }
-
-    return FamilyProgress{familyName, value, familySize[familyName]}, nil
-}
-
-// retuns FamilyProgress array containing user progress for all families
-func getTotalUserProgress(userId int) ([]FamilyProgress, error) {
-    progress := make([]FamilyProgress, 0)
-    for _, family := range families {
-        familyProgress, err := getUserProgress(userId, family.Name)
-        if err != nil {
-            return nil, err
-        }
-        
-        progress = append(progress, familyProgress)
-    }
-
-    return progress, nil
-}
-
 /******************************************************************************
  * Handlers
  *****************************************************************************/
@@ -206,6 +202,11 @@ func handleRegistration(c *gin.Context) {
     emailAddr := c.PostForm("email")
     password  := c.PostForm("password")
 
+    // display name is optional, users get a default one otherwise
+    var displayName sql.NullString
+    displayName.String = c.PostForm("display_name")
+    displayName.Valid = displayName.String != ""
+
     // check lengths of names and password
     if len(firstName) < 1 || len(lastName) < 1 {
         c.JSON(400, gin.H{"error": "name is not valid"})
@@ -223,6 +224,14 @@ func handleRegistration(c *gin.Context) {
         return
     }
 
+    // check display name
+    if displayName.Valid {
+        if problem := checkDisplayName(displayName.String); problem != "" {
+            c.JSON(400, gin.H{"error": problem})
+            return
+        }
+    }
+
     // bcrypt password
     hash, err := bcrypt.GenerateFromPassword([]byte(password), BcryptCostFactor)
     if err != nil {
@@ -230,19 +239,29 @@ func handleRegistration(c *gin.Context) {
         return
     }
 
-    // insert user into the database
+    // insert user into the database, addresses differing only in case are
+    // refused by the user_email_lower_key index
     var userId int
     err = stores.sqlPool.QueryRow(
         "INSERT INTO webapp.user(first_name, last_name, email," +
-                                   "password, registration_time, last_login)" +
-        "VALUES ($1, $2, $3, $4, NOW(), NOW()) RETURNING user_id",
-        firstName, lastName, emailAddr, hash).Scan(&userId)
+                                   "password, display_name, " +
+                                   "registration_time, last_login)" +
+        "VALUES ($1, $2, $3, $4, $5, NOW(), NOW()) RETURNING user_id",
+        firstName, lastName, emailAddr, hash, displayName).Scan(&userId)
 
-    if err != nil || userId <= 0 {
+    if isDisplayNameTaken(err) {
+        c.JSON(400, gin.H{"error": "display name is already taken"})
+        return
+    } else if err != nil || userId <= 0 {
         c.JSON(400, gin.H{"error": "registration failed, please try again"})
         return
     }
-    
+
+    // ask the user to confirm their address, they can request another
+    sendMailLater("verification mail", func() error {
+        return sendVerifyMail(userId, emailAddr)
+    })
+
     // create session
     success := createUserSession(c, userId)
     if !success {
@@ -271,10 +290,12 @@ func handleLogin(c *gin.Context) {
 
     err := stores.sqlPool.QueryRow(
         "SELECT user_id, email, password FROM webapp.user " +
-        "WHERE email=$1", emailAddr).Scan(&userId, &email, &passwordHash)
+        "WHERE lower(email)=lower($1)", emailAddr).Scan(&userId, &email, &passwordHash)
 
-    // check if we got a result row
+    // check if we got a result row, unknown accounts count towards lockout
+    // too so it doesn't reveal which exist
     if err != nil || userId <= 0 {
+        recordLoginFailure(emailAddr)
         c.JSON(400, gin.H{"error": "email or password is incorrect"})
         return
     }
@@ -282,15 +303,18 @@ func handleLogin(c *gin.Context) {
     // check that password matches stored hash
     err = bcrypt.CompareHashAndPassword(passwordHash, []byte(password))
     if err != nil {
+        recordLoginFailure(emailAddr)
         c.JSON(400, gin.H{"error": "email or password is incorrect"})
         return
     }
+    clearLoginFailures(emailAddr)
     
     // create session
     success := createUserSession(c, userId)
     if !success {
         c.JSON(401, gin.H{"message": "unexpected error occurred"})
     } else {
+        recordLogin(userId)
         c.JSON(200, gin.H{"message": "login successful"})
     }
 }
@@ -304,10 +328,11 @@ func handleLogout(c *gin.Context) {
     }
 
     // delete session & send back null cookie
-    con := stores.redisPool.Get()
-    defer con.Close()
+    if err := deleteUserSession(userId, sessionTokenHash(token)); err != nil {
+        c.JSON(500, gin.H{"error": "unexpected error occurred"})
+        return
+    }
 
-    con.Do("DEL", "session_" + token)
     http.SetCookie(c.Writer, createSessionCookie("", -1))
     c.JSON(200, gin.H{"message": "logged out"})
 }
@@ -324,9 +349,16 @@ func handleProfile(c *gin.Context) {
     var firstName string
     var lastName string
     var email string
+    var emailVerified bool
+    var displayName sql.NullString
+    var showRealName bool
+    var role string
     err := stores.sqlPool.QueryRow(
-        "SELECT first_name, last_name, email FROM webapp.user " +
-        "WHERE user_id=$1", userId).Scan(&firstName, &lastName, &email)
+        "SELECT first_name, last_name, email, email_verified, " +
+        "display_name, show_real_name, role " +
+        "FROM webapp.user WHERE user_id=$1", userId).Scan(
+        &firstName, &lastName, &email, &emailVerified,
+        &displayName, &showRealName, &role)
 
     if err != nil {
         c.JSON(500, gin.H{"loggedIn": true,
@@ -341,55 +373,13 @@ func handleProfile(c *gin.Context) {
         c.JSON(500, gin.H{"loggedIn": true, "error": "no progress"})
     }
 
-    p := Profile{true, firstName, lastName, email, progress}
-    c.JSON(200, p)
-}
-
-func handleGetProgress(c *gin.Context) {
-    // get userid of logged in user, abort if 0
-    userId, _ := getLoggedInUser(c)
-    if userId <= 0 {
-        c.JSON(401, gin.H{"error": "not logged in"})
-        return
+    if !displayName.Valid {
+        displayName.String = defaultDisplayName(userId)
     }
 
-    familyName    := c.Param("family")
-    progress, err := getUserProgress(userId, familyName)
-    if err != nil {
-        c.JSON(500, gin.H{"error": "no progress"})
-        return
-    }
-
-    c.JSON(200, progress)
-}
-
-func handleSetProgress(c *gin.Context) {
-    // get userid of logged in user, abort if 0
-    userId, _ := getLoggedInUser(c)
-    if userId <= 0 {
-        c.JSON(401, gin.H{"error": "not logged in"})
-        return
-    }
-
-    familyName := c.Param("family")
-    newProgress, err := strconv.ParseUint(c.PostForm("progress"), 10, 64)
-    if err != nil {
-        c.JSON(400, gin.H{"error": "invalid progress value"})
-        return
-    }
-
-    valid, err := setUserProgress(userId, familyName, newProgress)
-    if err != nil {
-        c.JSON(500, gin.H{"error": "unexpected error occurred"})
-        return
-    }
-
-    if !valid {
-        c.JSON(400, gin.H{"error": "invalid progress value"})
-        return
-    }
-
-    c.JSON(200, gin.H{"message": "progress has been updated"})
+    p := Profile{true, firstName, lastName, email, emailVerified,
+                 displayName.String, showRealName, role, progress}
+    c.JSON(200, p)
 }
 
 /******************************************************************************
@@ -398,8 +388,8 @@ func handleSetProgress(c *gin.Context) {
 
 // setup /user routes
 func userRoutes(user *gin.RouterGroup) {
-    // test routes
-    user.GET("/redis", func(c *gin.Context) {
+    // debug routes, for admins only
+    user.GET("/redis", RequireRole(RoleAdmin), func(c *gin.Context) {
         con := stores.redisPool.Get()
         defer con.Close()
 
@@ -411,21 +401,61 @@ func userRoutes(user *gin.RouterGroup) {
         }
     })
 
-    user.GET("/pgsql", func(c *gin.Context) {
+    user.GET("/pgsql", RequireRole(RoleAdmin), func(c *gin.Context) {
         // check if connection valid
-        _, err := stores.sqlPool.Query("SELECT * FROM webapp.user")
-        if err != nil {
+        if err := stores.sqlPool.Ping(); err != nil {
             c.JSON(500, gin.H{"error": "PG is DOWN"})
+            return
         }
 
         c.JSON(200, gin.H{"error": "PG is UP"})
     })
 
     // handle user actions
-    user.POST("/register", handleRegistration)
-    user.POST("/login", handleLogin)
+    user.POST("/register",
+              RateLimit("register", RegisterIPLimit, time.Hour, byClientIP),
+              handleRegistration)
+    user.POST("/login",
+              RateLimit("login-ip", LoginIPLimit, time.Minute, byClientIP),
+              RateLimit("login-account", LoginAccountLimit, time.Minute,
+                        byEmail),
+              LoginLockout, handleLogin)
     user.POST("/logout", handleLogout)
-    user.GET("/profile", handleProfile)
-    user.GET("/progress/:family", handleGetProgress)
-    user.POST("/progress/:family", handleSetProgress)
+    user.GET("/sessions", handleListSessions)
+    user.DELETE("/sessions", handleRevokeSessions)
+    user.DELETE("/sessions/:session", handleRevokeSession)
+    user.GET("/profile", TokenScope(ScopeProfile), handleProfile)
+    user.PATCH("/profile", handleUpdateProfile)
+    user.POST("/password",
+              RateLimit("password-ip", PasswordIPLimit, time.Hour, byClientIP),
+              RateLimit("password-account", PasswordAccountLimit, time.Hour,
+                        byUser),
+              handleChangePassword)
+    user.DELETE("", handleDeleteAccount)
+    user.GET("/export", handleExport)
+    user.GET("/progress", TokenScope(ScopeProgress), handleGetLearned)
+    user.GET("/progress/:family", TokenScope(ScopeProgress), handleGetProgress)
+    user.POST("/progress/:family", TokenScope(ScopeProgress), handleSetProgress)
+
+    // handle api tokens, which can't be used to manage themselves
+    user.GET("/tokens", handleListTokens)
+    user.POST("/tokens", handleCreateToken)
+    user.DELETE("/tokens/:token", handleRevokeToken)
+
+    // handle login with external providers
+    user.GET("/oidc", handleLoginProviders)
+    user.GET("/oidc/:provider/login", handleOIDCLogin)
+    user.GET("/oidc/:provider/callback", handleOIDCCallback)
+
+    // handle forgotten passwords
+    user.POST("/password/forgot",
+              RateLimit("forgot-ip", ForgotIPLimit, time.Hour, byClientIP),
+              RateLimit("forgot-account", ForgotAccountLimit, time.Hour,
+                        byEmail),
+              handleForgotPassword)
+    user.POST("/password/reset", handleResetPassword)
+
+    // handle email verification
+    user.POST("/verify", handleVerifyEmail)
+    user.POST("/verify/resend", handleResendVerification)
 }
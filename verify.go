@@ -0,0 +1,218 @@
+package main
+
+import (
+  "encoding/base64"
+  "log"
+  "strconv"
+  "time"
+  "github.com/gin-gonic/gin"
+  "github.com/garyburd/redigo/redis"
+)
+
+/******************************************************************************
+ * Constants
+ *****************************************************************************/
+
+const (
+    VerifyTokenBytes     int           = 32
+    VerifyTokenMaxAge    time.Duration = time.Hour * 72
+    VerifyResendInterval time.Duration = time.Minute * 5
+)
+
+/******************************************************************************
+ * Helper functions
+ *****************************************************************************/
+
+// create a verification token for the address the user currently has, only
+// its hash is stored as with sessions
+func createVerifyToken(userId int, emailAddr string) (string, error) {
+    bytes, err := generateRandomId(VerifyTokenBytes)
+    if err != nil {
+        return "", err
+    }
+
+    con := stores.redisPool.Get()
+    defer con.Close()
+
+    // remember the address so a token can't verify one changed since
+    ttl := int(VerifyTokenMaxAge.Seconds())
+    key := "verify:" + hashToken(bytes)
+    con.Send("MULTI")
+    con.Send("HSET", key, "user", userId, "email", emailAddr)
+    con.Send("EXPIRE", key, ttl)
+    if _, err = con.Do("EXEC"); err != nil {
+        return "", err
+    }
+
+    return base64.URLEncoding.EncodeToString(bytes), nil
+}
+
+// return the user id and address a verification token was issued for and
+// delete the token, 0 if the token is invalid or expired
+func consumeVerifyToken(token string) (int, string) {
+    bytes, err := base64.URLEncoding.DecodeString(token)
+    if err != nil || len(bytes) != VerifyTokenBytes {
+        return 0, ""
+    }
+
+    con := stores.redisPool.Get()
+    defer con.Close()
+
+    // get and delete atomically so the token can only be used once
+    key := "verify:" + hashToken(bytes)
+    con.Send("MULTI")
+    con.Send("HMGET", key, "user", "email")
+    con.Send("DEL", key)
+    r, err := redis.Values(con.Do("EXEC"))
+    if err != nil || len(r) != 2 {
+        return 0, ""
+    }
+
+    fields, err := redis.Strings(r[0], nil)
+    if err != nil || len(fields) != 2 {
+        return 0, ""
+    }
+
+    userId, err := strconv.Atoi(fields[0])
+    if err != nil {
+        return 0, ""
+    }
+
+    return userId, fields[1]
+}
+
+// email a verification link for the user's address
+func sendVerifyMail(userId int, emailAddr string) error {
+    token, err := createVerifyToken(userId, emailAddr)
+    if err != nil {
+        return err
+    }
+
+    body := "Welcome to Firmament!\n\n" +
+            "Follow this link to confirm your email address:\n\n" +
+            siteURL + "/?verify=" + token + "\n\n" +
+            "If you didn't create an account, you can safely ignore this email."
+    return mailer.Send(emailAddr, "Confirm your Firmament email address", body)
+}
+
+// returns whether the user has confirmed their email address
+func isEmailVerified(userId int) (bool, error) {
+    var verified bool
+    err := stores.sqlPool.QueryRow(
+        "SELECT email_verified FROM webapp.user " +
+        "WHERE user_id=$1", userId).Scan(&verified)
+    return verified, err
+}
+
+/******************************************************************************
+ * Middleware
+ *****************************************************************************/
+
+// only let users with a verified email address through
+func RequireVerified(c *gin.Context) {
+    // get userid of logged in user, abort if 0
+    userId, _ := getLoggedInUser(c)
+    if userId <= 0 {
+        c.AbortWithStatusJSON(401, gin.H{"error": "not logged in"})
+        return
+    }
+
+    verified, err := isEmailVerified(userId)
+    if err != nil {
+        c.AbortWithStatusJSON(500, gin.H{"error": "unexpected error occurred"})
+        return
+    }
+
+    if !verified {
+        c.AbortWithStatusJSON(403, gin.H{"error": "please verify your " +
+                                                  "email address first"})
+        return
+    }
+}
+
+/******************************************************************************
+ * Handlers
+ *****************************************************************************/
+
+func handleVerifyEmail(c *gin.Context) {
+    userId, emailAddr := consumeVerifyToken(c.PostForm("token"))
+    if userId <= 0 {
+        c.JSON(400, gin.H{"error": "verification link is invalid " +
+                                   "or has expired"})
+        return
+    }
+
+    // only verify the address the link was sent to
+    r, err := stores.sqlPool.Exec(
+        "UPDATE webapp.user SET email_verified=TRUE " +
+        "WHERE user_id=$1 AND lower(email)=lower($2)", userId, emailAddr)
+    if err != nil {
+        c.JSON(500, gin.H{"error": "an error occurred, please try again"})
+        return
+    }
+
+    if rows, _ := r.RowsAffected(); rows != 1 {
+        c.JSON(400, gin.H{"error": "verification link is invalid " +
+                                   "or has expired"})
+        return
+    }
+
+    // verified users can do more, so give them a fresh session
+    if loggedIn, token := getLoggedInUser(c); loggedIn == userId {
+        rotateUserSession(c, userId, token)
+    }
+
+    c.JSON(200, gin.H{"message": "email address has been verified"})
+}
+
+func handleResendVerification(c *gin.Context) {
+    // get userid of logged in user, abort if 0
+    userId, _ := getLoggedInUser(c)
+    if userId <= 0 {
+        c.JSON(401, gin.H{"error": "not logged in"})
+        return
+    }
+
+    var email string
+    var verified bool
+    err := stores.sqlPool.QueryRow(
+        "SELECT email, email_verified FROM webapp.user " +
+        "WHERE user_id=$1", userId).Scan(&email, &verified)
+    if err != nil {
+        c.JSON(500, gin.H{"error": "unexpected error occurred"})
+        return
+    }
+
+    if verified {
+        c.JSON(400, gin.H{"error": "email address is already verified"})
+        return
+    }
+
+    // only allow one email per interval so we can't be used to spam
+    con := stores.redisPool.Get()
+    defer con.Close()
+
+    interval := int(VerifyResendInterval.Seconds())
+    _, err = redis.String(con.Do("SET", "verify-resend:" + strconv.Itoa(userId),
+                                 1, "EX", interval, "NX"))
+    if err == redis.ErrNil {
+        ttl, _ := redis.Int(con.Do("TTL", "verify-resend:" + strconv.Itoa(userId)))
+        if ttl > 0 {
+            c.Header("Retry-After", strconv.Itoa(ttl))
+        }
+        c.JSON(429, gin.H{"error": "an email was sent recently, " +
+                                   "please check your inbox"})
+        return
+    } else if err != nil {
+        c.JSON(500, gin.H{"error": "unexpected error occurred"})
+        return
+    }
+
+    if err = sendVerifyMail(userId, email); err != nil {
+        log.Println("failed to send verification mail:", err)
+        c.JSON(500, gin.H{"error": "unable to send email, please try again"})
+        return
+    }
+
+    c.JSON(200, gin.H{"message": "verification email has been sent"})
+}